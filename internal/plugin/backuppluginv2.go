@@ -18,46 +18,55 @@ package plugin
 
 import (
 	"context"
+	"fmt"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/pkg/errors"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
 	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
-	biav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/backupitemaction/v2"
+
+	bsutil "github.com/longhorn/backupstore/util"
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
 )
 
 const (
-	// If this annotation is found on the Velero Backup CR, then create an operation
-	// that is considered done at backup start time + example BIA operation duration
-	// If this annotation is not present, then operationID returned from Execute() will
-	// be empty.
-	// This annotation can also be set on the item, which overrides the backup CR value,
-	// to allow for testing multiple action lengths
-	AsyncBIADurationAnnotation = "velero.io/example-bia-operation-duration"
-	// If this annotation is true on the item, then if the BIA duration is set to a
-	// non-zero value, a Secret will be created, and it will be returned as an additional
-	// item with the UpdateAdditionalItemsAfterOperation return flag set to true
-	AsyncBIAAdditionalUpdateAnnotation = "velero.io/example-bia-additional-update"
-	AsyncBIAProgressAnnotation         = "velero.io/example-bia-progress"
-	AsyncBIAExampleSecretAnnotation    = "velero.io/example-bia-secret"
-	AsyncBIAExampleLabel               = "velero.io/example-bia"
+	// dataMoverConfigKey enables backing up the data of Longhorn PVCs to the
+	// Longhorn backup target as asynchronous operations.
+	dataMoverConfigKey = "dataMover"
+	// dataMoverAnnotation on the Velero backup overrides the dataMover config.
+	dataMoverAnnotation = "velero.io/longhorn-data-mover"
+	// labelSelectorConfigKey restricts the action to PVCs and PVs matching a
+	// label selector. Longhorn CRs are always sanitized.
+	labelSelectorConfigKey = "labelSelector"
 )
 
-// BackupPluginV2 is a v2 backup item action plugin for Velero.
+// BackupPluginV2 is a v2 backup item action plugin for Velero. It backs up the
+// Longhorn side of PVCs and PVs provisioned by the Longhorn CSI driver.
 type BackupPluginV2 struct {
-	log logrus.FieldLogger
+	log    logrus.FieldLogger
+	client *longhornClient
+	cache  *longhornCache
+	config map[string]string
+
+	snapshotTimeout time.Duration
+	labelSelector   labels.Selector
+
+	// systemBackups holds the names of the SystemBackups this instance started.
+	systemBackups sync.Map
 }
 
 // NewBackupPluginV2 instantiates a v2 BackupPlugin.
@@ -69,179 +78,501 @@ func NewBackupPluginV2(log logrus.FieldLogger) *BackupPluginV2 {
 // method -- it's used to tell velero what name it was registered under. The plugin implementation
 // must define it, but it will never actually be called.
 func (p *BackupPluginV2) Name() string {
-	return "exampleBackupPlugin"
+	return "longhornBackupPlugin"
 }
 
 // AppliesTo returns information about which resources this action should be invoked for.
 // The IncludedResources and ExcludedResources slices can include both resources
 // and resources with group names. These work: "ingresses", "ingresses.extensions".
 // A BackupPlugin's Execute function will only be invoked on items that match the returned
-// selector. A zero-valued ResourceSelector matches all resources.
+// selector. A zero-valued ResourceSelector matches all resources. The configured
+// label selector only applies to PVCs and PVs, so Execute evaluates it.
 func (p *BackupPluginV2) AppliesTo() (velero.ResourceSelector, error) {
-	// exclude secrets to avoid infinite loop, since this plugin creates secrets as additional items.
-	return velero.ResourceSelector{ExcludedResources: []string{"secrets"}}, nil
+	return velero.ResourceSelector{
+		IncludedResources: append([]string{
+			kuberesource.PersistentVolumeClaims.String(),
+			kuberesource.PersistentVolumes.String(),
+		}, longhornResources()...),
+	}, nil
 }
 
-func GetClient() (*kubernetes.Clientset, error) {
-	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	configOverrides := &clientcmd.ConfigOverrides{}
-	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
-	clientConfig, err := kubeConfig.ClientConfig()
-	if err != nil {
-		return nil, errors.WithStack(err)
+// init creates the API client and the shared cache on first use, since backup
+// item actions have no Init hook.
+func (p *BackupPluginV2) init() error {
+	if p.client == nil {
+		client, err := newLonghornClient(p.log, nil)
+		if err != nil {
+			return err
+		}
+		p.client = client
 	}
-
-	client, err := kubernetes.NewForConfig(clientConfig)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	if p.cache == nil {
+		lhCache, err := getLonghornCache(p.client)
+		if err != nil {
+			return err
+		}
+		p.cache = lhCache
+	}
+	if p.config == nil {
+		config, err := p.client.getPluginConfig(common.PluginKindBackupItemActionV2, BackupPluginV2Name)
+		if err != nil {
+			return err
+		}
+		if err := p.client.configure(config); err != nil {
+			return err
+		}
+		if p.snapshotTimeout, err = durationConfig(config, snapshotTimeoutConfigKey, defaultSnapshotTimeout); err != nil {
+			return err
+		}
+		if p.labelSelector, err = labels.Parse(config[labelSelectorConfigKey]); err != nil {
+			return errors.Wrapf(err, "invalid %s %q", labelSelectorConfigKey, config[labelSelectorConfigKey])
+		}
+		p.config = config
 	}
+	return nil
+}
 
-	return client, nil
+// dataMoverEnabled reports whether the data of Longhorn PVCs in backup is
+// backed up by the action.
+func (p *BackupPluginV2) dataMoverEnabled(backup *v1.Backup) (bool, error) {
+	if v, ok := backup.Annotations[dataMoverAnnotation]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, errors.Errorf("invalid %s annotation %q on backup %s", dataMoverAnnotation, v, backup.Name)
+		}
+		return enabled, nil
+	}
+	return boolConfig(p.config, dataMoverConfigKey, false)
 }
 
 // Execute allows the ItemAction to perform arbitrary logic with the item being backed up,
-// in this case, setting a custom annotation on the item being backed up.
+// in this case, returning the Longhorn Volume CR backing a Longhorn PVC or PV, and the
+// objects it depends on, as additional items. Longhorn CRs are stripped of the state
+// of the source cluster. The first item that starts no operation of its own starts
+// the Longhorn SystemBackup of the backup, if enabled.
 func (p *BackupPluginV2) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, string, []velero.ResourceIdentifier, error) {
-	p.log.Info("Hello from my BackupPlugin(v2)!")
+	updatedItem, additionalItems, operationID, itemsToUpdate, err := p.executeItem(item, backup)
+	if err != nil || operationID != "" {
+		return updatedItem, additionalItems, operationID, itemsToUpdate, err
+	}
+	// Only items with a Longhorn side start the SystemBackup, so backups
+	// without Longhorn objects never set up the client.
+	if item.GetObjectKind().GroupVersionKind().Group != longhornVolumes.Group && len(additionalItems) == 0 {
+		return updatedItem, additionalItems, operationID, itemsToUpdate, nil
+	}
+	operationID, err = p.startSystemBackup(backup)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	return updatedItem, additionalItems, operationID, itemsToUpdate, nil
+}
+
+// executeItem backs up the Longhorn side of a single item.
+func (p *BackupPluginV2) executeItem(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, string, []velero.ResourceIdentifier, error) {
+	if gvk := item.GetObjectKind().GroupVersionKind(); gvk.Group == longhornVolumes.Group {
+		additionalItems, err := p.longhornAdditionalItems(item)
+		if err != nil {
+			return nil, nil, "", nil, err
+		}
+		return sanitizeLonghornItem(item), additionalItems, "", nil, nil
+	}
+
+	pv, err := p.boundPersistentVolume(item)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if pv == nil {
+		return item, nil, "", nil, nil
+	}
+	volumeName := longhornVolumeName(pv)
+	if volumeName == "" {
+		return item, nil, "", nil, nil
+	}
 
+	log := p.log.WithField("volume", volumeName)
+	if err := p.init(); err != nil {
+		return nil, nil, "", nil, err
+	}
 	metadata, err := meta.Accessor(item)
 	if err != nil {
+		return nil, nil, "", nil, errors.WithStack(err)
+	}
+	if !p.labelSelector.Matches(labels.Set(metadata.GetLabels())) {
+		return item, nil, "", nil, nil
+	}
+
+	additionalItems, err := p.volumeAdditionalItems(volumeName, metadata.GetLabels())
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	log.Infof("Backing up %d Longhorn objects with persistent volume %s", len(additionalItems), pv.Name)
+
+	// Back up the data once per volume, through its PVC.
+	if item.GetObjectKind().GroupVersionKind().Kind != "PersistentVolumeClaim" {
+		return item, additionalItems, "", nil, nil
+	}
+
+	// Operations during finalize aren't supported. The PVC is backed up again
+	// in a finalize phase once its Longhorn backup finished, to record it.
+	if backup.Status.Phase == v1.BackupPhaseFinalizing ||
+		backup.Status.Phase == v1.BackupPhaseFinalizingPartiallyFailed {
+		if err := p.recordVolumeParams(item, volumeName, pv); err != nil {
+			return nil, nil, "", nil, err
+		}
+		item, err = p.annotateLonghornBackup(item, backup)
+		return item, additionalItems, "", nil, err
+	}
+	enabled, err := p.dataMoverEnabled(backup)
+	if err != nil || !enabled {
+		return item, additionalItems, "", nil, err
+	}
+
+	// The restore action recreates the volume from the PVC alone.
+	if err := p.recordVolumeParams(item, volumeName, pv); err != nil {
+		return nil, nil, "", nil, err
+	}
+	op, err := p.startBackup(metadata.GetNamespace(), volumeName, backup)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	log.Infof("Started Longhorn backup %s of snapshot %s", op.backupName, op.snapshotName)
+
+	manifest := &backupManifest{
+		Version:      backupManifestVersion,
+		PVCNamespace: metadata.GetNamespace(),
+		PVCName:      metadata.GetName(),
+		PVName:       pv.Name,
+		VolumeName:   volumeName,
+		SnapshotName: op.snapshotName,
+		BackupName:   op.backupName,
+		State:        longhorn.BackupStatePending,
+	}
+	if err := p.client.createBackupManifest(manifest, map[string]string{v1.BackupNameLabel: label.GetValidName(backup.Name)}); err != nil {
 		return nil, nil, "", nil, err
 	}
+	// The manifest is backed up now and again once Progress has recorded the
+	// final state of the Longhorn backup in it.
+	manifestItem := velero.ResourceIdentifier{
+		GroupResource: configMaps,
+		Namespace:     manifest.PVCNamespace,
+		Name:          op.backupName,
+	}
+	additionalItems = append(additionalItems, manifestItem)
+	pvcItem := velero.ResourceIdentifier{
+		GroupResource: kuberesource.PersistentVolumeClaims,
+		Namespace:     manifest.PVCNamespace,
+		Name:          manifest.PVCName,
+	}
+
+	return item, additionalItems, op.String(), []velero.ResourceIdentifier{manifestItem, pvcItem}, nil
+}
+
+// recordVolumeParams records the parameters of the Longhorn volume behind a
+// PVC on the PVC stored in the Velero backup.
+func (p *BackupPluginV2) recordVolumeParams(item runtime.Unstructured, volumeName string, pv *corev1api.PersistentVolume) error {
+	vol, err := p.cache.volumes.Get(volumeName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get volume %s", volumeName)
+	}
+	params := newVolumeParams(vol)
+	params.FSType = pv.Spec.CSI.FSType
 
+	metadata, err := meta.Accessor(item)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	annotations := metadata.GetAnnotations()
 	if annotations == nil {
-		annotations = make(map[string]string)
+		annotations = map[string]string{}
 	}
+	if err := params.setAnnotation(annotations); err != nil {
+		return err
+	}
+	metadata.SetAnnotations(annotations)
+	return nil
+}
 
-	annotations["velero.io/my-backup-pluginv2"] = "1"
+// annotateLonghornBackup sets the name, URL and state of the Longhorn backup
+// of a PVC on the PVC stored in the Velero backup. The PVC in the cluster is
+// left alone. The manifest ConfigMap is then deleted from the cluster: Velero
+// collects every item of the finalize pass before backing any of them up, so
+// the backup already holds its final copy.
+func (p *BackupPluginV2) annotateLonghornBackup(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, error) {
+	metadata, err := meta.Accessor(item)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	manifest, err := p.client.getPVCBackupManifest(backup.Name, metadata.GetNamespace(), metadata.GetName())
+	if err != nil || manifest == nil {
+		return item, err
+	}
+	if err := p.client.deleteBackupManifest(manifest.PVCNamespace, manifest.BackupName); err != nil {
+		return nil, err
+	}
+	if manifest.State != longhorn.BackupStateCompleted {
+		return item, nil
+	}
 
+	annotations := metadata.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for k, v := range manifest.annotations() {
+		annotations[k] = v
+	}
 	metadata.SetAnnotations(annotations)
+	return item, nil
+}
 
-	// Operations during finalize aren't supported, so if backup is in a finalize phase, just return the item
-	if backup.Status.Phase == v1.BackupPhaseFinalizing ||
-		backup.Status.Phase == v1.BackupPhaseFinalizingPartiallyFailed {
-		return item, nil, "", nil, nil
+// startBackup snapshots the volume and creates a Longhorn backup of the
+// snapshot. Longhorn uploads the backup in the background.
+func (p *BackupPluginV2) startBackup(pvcNamespace, volumeName string, backup *v1.Backup) (backupOperation, error) {
+	op := backupOperation{
+		pvcNamespace: pvcNamespace,
+		volumeName:   volumeName,
+		snapshotName: "velero-" + bsutil.GenerateName("snap"),
+		backupName:   "velero-" + bsutil.GenerateName("backup"),
 	}
+	labels := map[string]string{v1.BackupNameLabel: label.GetValidName(backup.Name)}
 
-	operationID := ""
-	duration := ""
-	if durationStr, ok := annotations[AsyncBIADurationAnnotation]; ok && len(durationStr) != 0 {
-		_, err := time.ParseDuration(durationStr)
-		if err == nil {
-			duration = durationStr
-		}
+	snapshot := &longhorn.Snapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   op.snapshotName,
+			Labels: labels,
+		},
+		Spec: longhorn.SnapshotSpec{
+			Volume:         volumeName,
+			CreateSnapshot: true,
+		},
 	}
-	if duration == "" && backup.Annotations != nil {
-		if durationStr, ok := backup.Annotations[AsyncBIADurationAnnotation]; ok && len(durationStr) != 0 {
-			_, err := time.ParseDuration(durationStr)
-			if err == nil {
-				duration = durationStr
-			}
-		}
+	if err := p.client.createSnapshot(snapshot); err != nil {
+		return op, err
 	}
-	// If duration is empty, we don't have an operation so just return the item.
-	if duration == "" {
-		return item, nil, "", nil, nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.snapshotTimeout)
+	defer cancel()
+	if err := p.cache.waitForSnapshotReady(ctx, op.snapshotName); err != nil {
+		return op, err
 	}
 
-	var secret *corev1api.Secret
-	var itemsToUpdate []velero.ResourceIdentifier
-	additionalUpdate, ok := annotations[AsyncBIAAdditionalUpdateAnnotation]
-	if ok && additionalUpdate == "true" {
-		secret = &corev1api.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace:    metadata.GetNamespace(),
-				GenerateName: metadata.GetName() + "-",
-				Labels: map[string]string{
-					AsyncBIAExampleLabel: "true",
-				},
-			},
-			Type: corev1api.SecretTypeOpaque,
-			Data: map[string][]byte{
-				"TestObject": []byte(metadata.GetName()),
-			},
-		}
-		secretClient, err := GetClient()
-		if err != nil {
-			return item, nil, "", nil, errors.Wrap(err, "error getting secret client")
+	if err := p.client.createBackup(op.backupName, volumeName, op.snapshotName, labels); err != nil {
+		return op, err
+	}
+	return op, nil
+}
+
+// longhornAdditionalItems returns the objects a Longhorn CR selected directly
+// by the backup depends on.
+func (p *BackupPluginV2) longhornAdditionalItems(item runtime.Unstructured) ([]velero.ResourceIdentifier, error) {
+	if item.GetObjectKind().GroupVersionKind().Kind != "Volume" {
+		return nil, nil
+	}
+	metadata, err := meta.Accessor(item)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+
+	items, err := p.volumeAdditionalItems(metadata.GetName(), nil)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	// The first item is the volume itself.
+	return items[1:], nil
+}
+
+// boundPersistentVolume returns the PV of a PV item or the PV bound to a PVC
+// item. It returns nil for an unbound PVC.
+func (p *BackupPluginV2) boundPersistentVolume(item runtime.Unstructured) (*corev1api.PersistentVolume, error) {
+	switch kind := item.GetObjectKind().GroupVersionKind().Kind; kind {
+	case "PersistentVolume":
+		pv := new(corev1api.PersistentVolume)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pv); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return pv, nil
+	case "PersistentVolumeClaim":
+		pvc := new(corev1api.PersistentVolumeClaim)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pvc); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if pvc.Spec.VolumeName == "" || pvc.Status.Phase != corev1api.ClaimBound {
+			return nil, nil
+		}
+
+		if err := p.init(); err != nil {
+			return nil, err
 		}
-		if secret, err = secretClient.CoreV1().Secrets(metadata.GetNamespace()).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
-			return item, nil, "", nil, errors.Wrapf(err, "error creating %s secret", metadata.GetName())
+		var pv *corev1api.PersistentVolume
+		err := p.client.call("get persistent volume "+pvc.Spec.VolumeName, func(ctx context.Context) error {
+			var err error
+			pv, err = p.client.k8s.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
+		return pv, nil
+	default:
+		return nil, errors.Errorf("unexpected item kind %s", kind)
 	}
+}
 
-	operationID = string(metadata.GetUID()) + "/" + duration
-	if secret != nil {
-		itemsToUpdate = []velero.ResourceIdentifier{
-			{
-				GroupResource: kuberesource.Secrets,
-				Namespace:     secret.Namespace,
-				Name:          secret.Name,
-			},
+// volumeAdditionalItems returns the Longhorn Volume CR named volumeName and the
+// Longhorn objects it needs to be recreated: its backing image and the
+// recurring jobs assigned to it by its labels or by itemLabels, the labels of
+// its PVC.
+func (p *BackupPluginV2) volumeAdditionalItems(volumeName string, itemLabels map[string]string) ([]velero.ResourceIdentifier, error) {
+	vol, err := p.cache.volumes.Get(volumeName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			p.log.Warnf("Longhorn volume %s not found, backing up the persistent volume without it", volumeName)
+			return nil, nil
 		}
-		operationID += "/" + secret.Namespace + "/" + secret.Name
-		annotations[AsyncBIAExampleSecretAnnotation] = secret.Name
-		metadata.SetAnnotations(annotations)
+		return nil, errors.Wrapf(err, "failed to get volume %s", volumeName)
+	}
 
+	items := []velero.ResourceIdentifier{
+		{
+			GroupResource: longhornVolumes,
+			Namespace:     longhornNamespace,
+			Name:          vol.Name,
+		},
 	}
-	return item, nil, operationID, itemsToUpdate, nil
+	if vol.Spec.BackingImage != "" {
+		items = append(items, velero.ResourceIdentifier{
+			GroupResource: longhornBackingImages,
+			Namespace:     longhornNamespace,
+			Name:          vol.Spec.BackingImage,
+		})
+	}
+
+	jobs, err := p.cache.referencedRecurringJobs(vol.Labels, itemLabels)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		items = append(items, velero.ResourceIdentifier{
+			GroupResource: longhornRecurringJobs,
+			Namespace:     longhornNamespace,
+			Name:          job.Name,
+		})
+	}
+	return items, nil
 }
 
+// Progress reports how far Longhorn got uploading the backup of an operation
+// started by Execute, or the state of the SystemBackup.
 func (p *BackupPluginV2) Progress(operationID string, backup *v1.Backup) (velero.OperationProgress, error) {
 	progress := velero.OperationProgress{}
-	if operationID == "" {
-		return progress, biav2.InvalidOperationIDError(operationID)
+	if err := p.init(); err != nil {
+		return progress, err
 	}
-	splitOp := strings.Split(operationID, "/")
-	if len(splitOp) == 4 {
-		secretClient, err := GetClient()
+	if name, ok, err := parseSystemBackupOperation(operationID); ok {
 		if err != nil {
-			return progress, errors.Wrap(err, "error getting secret client")
-		}
-		secret, err := secretClient.CoreV1().Secrets(splitOp[2]).Get(context.TODO(), splitOp[3], metav1.GetOptions{})
-		if err != nil {
-			return progress, errors.Wrapf(err, "error getting %s secret", splitOp[3])
-		}
-		annotations := secret.Annotations
-		if annotations == nil {
-			annotations = make(map[string]string)
-		}
-		priorProgressCalls := 0
-		progressAnnotation, ok := annotations[AsyncBIAProgressAnnotation]
-		if ok {
-			i, err := strconv.Atoi(progressAnnotation)
-			if err == nil {
-				priorProgressCalls = i
-			}
-		}
-		annotations[AsyncBIAProgressAnnotation] = strconv.Itoa(priorProgressCalls + 1)
-		secret.Annotations = annotations
-		if _, err := secretClient.CoreV1().Secrets(splitOp[2]).Update(context.TODO(), secret, metav1.UpdateOptions{}); err != nil {
-			return progress, errors.Wrapf(err, "error updating %s secret", splitOp[3])
+			return progress, err
 		}
-
-	} else if len(splitOp) != 2 {
-		return progress, biav2.InvalidOperationIDError(operationID)
+		return p.systemBackupProgress(name, backup)
 	}
-	duration, err := time.ParseDuration(splitOp[1])
+	op, err := parseBackupOperation(operationID)
 	if err != nil {
-		return progress, biav2.InvalidOperationIDError(operationID)
+		return progress, err
 	}
-	elapsed := time.Since(backup.Status.StartTimestamp.Time).Seconds()
-	if elapsed >= duration.Seconds() {
-		progress.Completed = true
-		progress.NCompleted = int64(duration.Seconds())
-	} else {
-		progress.NCompleted = int64(elapsed)
+
+	lhBackup, err := p.client.getBackup(p.cache, op.backupName)
+	if err != nil {
+		return progress, err
+	}
+	if lhBackup == nil {
+		// Execute creates the backup before it hands out the operation, so a
+		// missing one is a stale read; report the backup as not started.
+		progress.Updated = time.Now()
+		progress.OperationUnits = "bytes"
+		return progress, nil
 	}
-	progress.NTotal = int64(duration.Seconds())
-	progress.OperationUnits = "seconds"
+
+	progress.Started = lhBackup.CreationTimestamp.Time
 	progress.Updated = time.Now()
+	progress.OperationUnits = "bytes"
+	progress.NTotal = p.backupVolumeSize(lhBackup)
+	progress.NCompleted = progress.NTotal * int64(lhBackup.Status.Progress) / 100
 
+	switch lhBackup.Status.State {
+	case longhorn.BackupStateCompleted:
+		progress.Completed = true
+		progress.NCompleted = progress.NTotal
+	case longhorn.BackupStateError:
+		progress.Completed = true
+		progress.Err = fmt.Sprintf("Longhorn backup %s of volume %s failed: %s", op.backupName, op.volumeName, lhBackup.Status.Error)
+	}
+	if progress.Completed {
+		if err := p.client.completeBackupManifest(op.pvcNamespace, lhBackup); err != nil {
+			return progress, err
+		}
+	}
 	return progress, nil
 }
 
+// backupVolumeSize returns the size in bytes of the volume being backed up.
+// Longhorn only fills in Status.VolumeSize once the backup starts, so until
+// then the size comes from the volume itself.
+func (p *BackupPluginV2) backupVolumeSize(lhBackup *longhorn.Backup) int64 {
+	if size, err := strconv.ParseInt(lhBackup.Status.VolumeSize, 10, 64); err == nil && size > 0 {
+		return size
+	}
+	volumeName := lhBackup.Status.VolumeName
+	if volumeName == "" {
+		volumeName = lhBackup.Labels[backupVolumeLabel]
+	}
+	if vol, err := p.cache.volumes.Get(volumeName); err == nil {
+		return vol.Spec.Size
+	}
+	return 0
+}
+
+// Cancel stops an in-flight Longhorn backup started by Execute by deleting its
+// Backup and Snapshot CRs and releasing the attachment tickets Longhorn took
+// for them. A backup that already completed is left alone, and cancelling an
+// operation twice is a no-op. A SystemBackup that is not ready yet is deleted.
 func (p *BackupPluginV2) Cancel(operationID string, backup *v1.Backup) error {
-	return nil
+	if err := p.init(); err != nil {
+		return err
+	}
+	if name, ok, err := parseSystemBackupOperation(operationID); ok {
+		if err != nil {
+			return err
+		}
+		p.log.WithField("systemBackup", name).Info("Cancelling Longhorn system backup")
+		return p.cancelSystemBackup(name)
+	}
+	op, err := parseBackupOperation(operationID)
+	if err != nil {
+		return err
+	}
+	log := p.log.WithField("volume", op.volumeName).WithField("backup", op.backupName)
+
+	lhBackup, err := p.cache.backups.Get(op.backupName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get backup %s", op.backupName)
+	}
+	if lhBackup != nil && lhBackup.Status.State == longhorn.BackupStateCompleted {
+		log.Info("Longhorn backup already completed, nothing to cancel")
+		return nil
+	}
+
+	log.Info("Cancelling Longhorn backup")
+	if err := p.client.deleteBackup(op.backupName); err != nil {
+		return err
+	}
+	if err := p.client.deleteSnapshot(op.snapshotName); err != nil {
+		return err
+	}
+	if err := p.client.deleteBackupManifest(op.pvcNamespace, op.backupName); err != nil {
+		return err
+	}
+	return p.client.releaseAttachmentTickets(op.volumeName,
+		longhorn.GetAttachmentTicketID(longhorn.AttacherTypeBackupController, op.backupName),
+		longhorn.GetAttachmentTicketID(longhorn.AttacherTypeSnapshotController, op.snapshotName))
 }
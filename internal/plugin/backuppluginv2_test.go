@@ -0,0 +1,267 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// newTestBackupPlugin returns a BackupPluginV2 with the data mover enabled,
+// running against fake clientsets seeded with objects. Longhorn takes the
+// snapshots it creates right away.
+func newTestBackupPlugin(t *testing.T, objects ...runtime.Object) *BackupPluginV2 {
+	client, lh := newFakeLonghornClient(objects...)
+	lh.PrependReactor("create", "snapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		action.(k8stesting.CreateAction).GetObject().(*longhorn.Snapshot).Status.ReadyToUse = true
+		return false, nil, nil
+	})
+	return &BackupPluginV2{
+		log:             client.log,
+		client:          client,
+		cache:           newFakeLonghornCache(t, client),
+		config:          map[string]string{dataMoverConfigKey: "true"},
+		snapshotTimeout: 10 * time.Second,
+		labelSelector:   labels.Everything(),
+	}
+}
+
+// testBoundPVCItem returns the item of the PVC app/data bound to the PV pvc-1.
+func testBoundPVCItem(t *testing.T) *unstructured.Unstructured {
+	pvc := &corev1api.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "data"},
+		Spec:       corev1api.PersistentVolumeClaimSpec{VolumeName: "pvc-1"},
+		Status:     corev1api.PersistentVolumeClaimStatus{Phase: corev1api.ClaimBound},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pvc)
+	require.NoError(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+// startTestBackup runs the backup item action on the PVC of
+// testBoundPVCItem and returns the operation it started.
+func startTestBackup(t *testing.T, p *BackupPluginV2, backup *v1.Backup) backupOperation {
+	_, additionalItems, operationID, itemsToUpdate, err := p.Execute(testBoundPVCItem(t), backup)
+	require.NoError(t, err)
+	op, err := parseBackupOperation(operationID)
+	require.NoError(t, err)
+
+	manifestItem := velero.ResourceIdentifier{GroupResource: configMaps, Namespace: "app", Name: op.backupName}
+	assert.Contains(t, additionalItems, manifestItem)
+	assert.Contains(t, itemsToUpdate, manifestItem)
+	return op
+}
+
+// setTestBackupStatus sets the status of the Longhorn backup of op and waits
+// for the cache to see it.
+func setTestBackupStatus(t *testing.T, p *BackupPluginV2, op backupOperation, status longhorn.BackupStatus) {
+	backups := p.client.lh.LonghornV1beta2().Backups(longhornNamespace)
+	lhBackup, err := backups.Get(context.Background(), op.backupName, metav1.GetOptions{})
+	require.NoError(t, err)
+	lhBackup.Status = status
+	_, err = backups.UpdateStatus(context.Background(), lhBackup, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		cached, err := p.cache.backups.Get(op.backupName)
+		return err == nil && cached.Status.State == status.State
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// testBackupObjects returns the PV pvc-1 and its Longhorn volume.
+func testBackupObjects() []runtime.Object {
+	return []runtime.Object{
+		testLonghornPV("pvc-1", "pvc-1"),
+		&longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "pvc-1"},
+			Spec:       longhorn.VolumeSpec{Size: gi, NumberOfReplicas: 3},
+		},
+	}
+}
+
+// testVeleroBackup returns the Velero backup "backup-1" in progress.
+func testVeleroBackup() *v1.Backup {
+	return &v1.Backup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "backup-1"},
+		Status:     v1.BackupStatus{Phase: v1.BackupPhaseInProgress},
+	}
+}
+
+func TestBackupExecute(t *testing.T) {
+	p := newTestBackupPlugin(t, testBackupObjects()...)
+	backup := testVeleroBackup()
+
+	op := startTestBackup(t, p, backup)
+	assert.Equal(t, "app", op.pvcNamespace)
+	assert.Equal(t, "pvc-1", op.volumeName)
+
+	ctx := context.Background()
+	snapshot, err := p.client.lh.LonghornV1beta2().Snapshots(longhornNamespace).Get(ctx, op.snapshotName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "pvc-1", snapshot.Spec.Volume)
+	assert.Equal(t, "backup-1", snapshot.Labels[v1.BackupNameLabel])
+	lhBackup, err := p.client.lh.LonghornV1beta2().Backups(longhornNamespace).Get(ctx, op.backupName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, op.snapshotName, lhBackup.Spec.SnapshotName)
+	assert.Equal(t, "pvc-1", lhBackup.Labels[backupVolumeLabel])
+
+	manifest, err := p.client.getPVCBackupManifest(backup.Name, "app", "data")
+	require.NoError(t, err)
+	require.NotNil(t, manifest)
+	assert.Equal(t, "pvc-1", manifest.VolumeName)
+	assert.Equal(t, op.backupName, manifest.BackupName)
+	assert.Equal(t, longhorn.BackupStatePending, manifest.State)
+}
+
+func TestBackupProgress(t *testing.T) {
+	t.Run("reports the upload progress", func(t *testing.T) {
+		p := newTestBackupPlugin(t, testBackupObjects()...)
+		op := startTestBackup(t, p, testVeleroBackup())
+		setTestBackupStatus(t, p, op, longhorn.BackupStatus{State: longhorn.BackupStateInProgress, Progress: 25})
+
+		progress, err := p.Progress(op.String(), testVeleroBackup())
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Equal(t, gi, progress.NTotal)
+		assert.Equal(t, gi/4, progress.NCompleted)
+	})
+
+	t.Run("records a completed backup in the manifest", func(t *testing.T) {
+		p := newTestBackupPlugin(t, testBackupObjects()...)
+		backup := testVeleroBackup()
+		op := startTestBackup(t, p, backup)
+		setTestBackupStatus(t, p, op, longhorn.BackupStatus{
+			State:      longhorn.BackupStateCompleted,
+			Progress:   100,
+			URL:        testBackupURL(testBackupTarget, op.backupName, "pvc-1"),
+			VolumeSize: "1073741824",
+		})
+
+		progress, err := p.Progress(op.String(), backup)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+		assert.Equal(t, gi, progress.NCompleted)
+
+		manifest, err := p.client.getPVCBackupManifest(backup.Name, "app", "data")
+		require.NoError(t, err)
+		require.NotNil(t, manifest)
+		assert.Equal(t, longhorn.BackupStateCompleted, manifest.State)
+		assert.Equal(t, testBackupURL(testBackupTarget, op.backupName, "pvc-1"), manifest.URL)
+	})
+
+	t.Run("reports a failed backup", func(t *testing.T) {
+		p := newTestBackupPlugin(t, testBackupObjects()...)
+		op := startTestBackup(t, p, testVeleroBackup())
+		setTestBackupStatus(t, p, op, longhorn.BackupStatus{State: longhorn.BackupStateError, Error: "backup target unavailable"})
+
+		progress, err := p.Progress(op.String(), testVeleroBackup())
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Contains(t, progress.Err, "backup target unavailable")
+	})
+
+	t.Run("reads a backup missing from the cache from the API server", func(t *testing.T) {
+		p := newTestBackupPlugin(t, testBackupObjects()...)
+		op := startTestBackup(t, p, testVeleroBackup())
+		setTestBackupStatus(t, p, op, longhorn.BackupStatus{State: longhorn.BackupStateCompleted, VolumeSize: "1073741824"})
+		// A cache of an empty cluster stands in for an informer that has
+		// not seen the backup yet.
+		lagging, _ := newFakeLonghornClient()
+		p.cache = newFakeLonghornCache(t, lagging)
+
+		progress, err := p.Progress(op.String(), testVeleroBackup())
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Equal(t, gi, progress.NCompleted)
+	})
+
+	t.Run("reports a missing backup as not started", func(t *testing.T) {
+		p := newTestBackupPlugin(t, testBackupObjects()...)
+		op := backupOperation{pvcNamespace: "app", volumeName: "pvc-1", snapshotName: "velero-snap-abc", backupName: "velero-backup-abc"}
+
+		progress, err := p.Progress(op.String(), testVeleroBackup())
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+	})
+}
+
+func TestBackupCancel(t *testing.T) {
+	t.Run("deletes the objects of the backup", func(t *testing.T) {
+		p := newTestBackupPlugin(t, testBackupObjects()...)
+		backup := testVeleroBackup()
+		op := startTestBackup(t, p, backup)
+		ctx := context.Background()
+		otherTicket := longhorn.GetAttachmentTicketID(longhorn.AttacherTypeCSIAttacher, "pod-1")
+		_, err := p.client.lh.LonghornV1beta2().VolumeAttachments(longhornNamespace).Create(ctx, &longhorn.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "pvc-1"},
+			Spec: longhorn.VolumeAttachmentSpec{AttachmentTickets: map[string]*longhorn.AttachmentTicket{
+				longhorn.GetAttachmentTicketID(longhorn.AttacherTypeBackupController, op.backupName):     {},
+				longhorn.GetAttachmentTicketID(longhorn.AttacherTypeSnapshotController, op.snapshotName): {},
+				otherTicket: {},
+			}},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		require.NoError(t, p.Cancel(op.String(), backup))
+
+		_, err = p.client.lh.LonghornV1beta2().Backups(longhornNamespace).Get(ctx, op.backupName, metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+		_, err = p.client.lh.LonghornV1beta2().Snapshots(longhornNamespace).Get(ctx, op.snapshotName, metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+		manifest, err := p.client.getPVCBackupManifest(backup.Name, "app", "data")
+		require.NoError(t, err)
+		assert.Nil(t, manifest)
+		va, err := p.client.lh.LonghornV1beta2().VolumeAttachments(longhornNamespace).Get(ctx, "pvc-1", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Len(t, va.Spec.AttachmentTickets, 1)
+		assert.Contains(t, va.Spec.AttachmentTickets, otherTicket)
+
+		// Cancelling twice is a no-op.
+		require.NoError(t, p.Cancel(op.String(), backup))
+	})
+
+	t.Run("leaves a completed backup alone", func(t *testing.T) {
+		p := newTestBackupPlugin(t, testBackupObjects()...)
+		backup := testVeleroBackup()
+		op := startTestBackup(t, p, backup)
+		setTestBackupStatus(t, p, op, longhorn.BackupStatus{State: longhorn.BackupStateCompleted})
+
+		require.NoError(t, p.Cancel(op.String(), backup))
+
+		_, err := p.client.lh.LonghornV1beta2().Backups(longhornNamespace).Get(context.Background(), op.backupName, metav1.GetOptions{})
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,172 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+
+	lhinformers "github.com/longhorn/longhorn-manager/k8s/pkg/client/informers/externalversions"
+	lhlisters "github.com/longhorn/longhorn-manager/k8s/pkg/client/listers/longhorn/v1beta2"
+)
+
+const (
+	// cacheResyncPeriod is how often the informers replay their whole cache.
+	// Watches deliver every change, so this is only a safety net.
+	cacheResyncPeriod = 10 * time.Minute
+	// cacheSyncTimeout bounds the initial list of the Longhorn CRs.
+	cacheSyncTimeout = 2 * time.Minute
+)
+
+// longhornCache holds informers and listers for the Longhorn CRs the plugins
+// read. One cache is shared by every plugin instance in the process, so a
+// backup of thousands of volumes costs one LIST and WATCH per kind instead of
+// one GET per volume.
+type longhornCache struct {
+	factory lhinformers.SharedInformerFactory
+
+	volumeInformer       cache.SharedIndexInformer
+	snapshotInformer     cache.SharedIndexInformer
+	backupInformer       cache.SharedIndexInformer
+	backupVolumeInformer cache.SharedIndexInformer
+	backupTargetInformer cache.SharedIndexInformer
+	recurringJobInformer cache.SharedIndexInformer
+	engineInformer       cache.SharedIndexInformer
+	nodeInformer         cache.SharedIndexInformer
+
+	volumes       lhlisters.VolumeNamespaceLister
+	snapshots     lhlisters.SnapshotNamespaceLister
+	backups       lhlisters.BackupNamespaceLister
+	backupVolumes lhlisters.BackupVolumeNamespaceLister
+	backupTargets lhlisters.BackupTargetNamespaceLister
+	recurringJobs lhlisters.RecurringJobNamespaceLister
+	engines       lhlisters.EngineNamespaceLister
+	nodes         lhlisters.NodeNamespaceLister
+}
+
+var (
+	sharedCacheLock sync.Mutex
+	sharedCache     *longhornCache
+)
+
+// getLonghornCache returns the process-wide cache, starting the informers and
+// waiting for their first sync on the first call. A failed sync stops its
+// informers and is retried by the next call.
+func getLonghornCache(client *longhornClient) (*longhornCache, error) {
+	sharedCacheLock.Lock()
+	defer sharedCacheLock.Unlock()
+	if sharedCache != nil {
+		return sharedCache, nil
+	}
+	stopCh := make(chan struct{})
+	c, err := newLonghornCache(client, stopCh)
+	if err != nil {
+		close(stopCh)
+		return nil, err
+	}
+	sharedCache = c
+	return sharedCache, nil
+}
+
+// newLonghornCache starts informers for the Longhorn CRs in the Longhorn
+// namespace. They run until stopCh is closed.
+func newLonghornCache(client *longhornClient, stopCh <-chan struct{}) (*longhornCache, error) {
+	factory := lhinformers.NewSharedInformerFactoryWithOptions(client.lh, cacheResyncPeriod, lhinformers.WithNamespace(longhornNamespace))
+	lh := factory.Longhorn().V1beta2()
+
+	c := &longhornCache{
+		factory: factory,
+
+		volumeInformer:       lh.Volumes().Informer(),
+		snapshotInformer:     lh.Snapshots().Informer(),
+		backupInformer:       lh.Backups().Informer(),
+		backupVolumeInformer: lh.BackupVolumes().Informer(),
+		backupTargetInformer: lh.BackupTargets().Informer(),
+		recurringJobInformer: lh.RecurringJobs().Informer(),
+		engineInformer:       lh.Engines().Informer(),
+		nodeInformer:         lh.Nodes().Informer(),
+
+		volumes:       lh.Volumes().Lister().Volumes(longhornNamespace),
+		snapshots:     lh.Snapshots().Lister().Snapshots(longhornNamespace),
+		backups:       lh.Backups().Lister().Backups(longhornNamespace),
+		backupVolumes: lh.BackupVolumes().Lister().BackupVolumes(longhornNamespace),
+		backupTargets: lh.BackupTargets().Lister().BackupTargets(longhornNamespace),
+		recurringJobs: lh.RecurringJobs().Lister().RecurringJobs(longhornNamespace),
+		engines:       lh.Engines().Lister().Engines(longhornNamespace),
+		nodes:         lh.Nodes().Lister().Nodes(longhornNamespace),
+	}
+
+	factory.Start(stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheSyncTimeout)
+	defer cancel()
+	for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, errors.Errorf("timed out waiting for the %v cache to sync", informerType)
+		}
+	}
+
+	return c, nil
+}
+
+// waitForObject blocks until check reports done, re-evaluating it whenever the
+// informer sees the named object change rather than polling the API server.
+// check normally reads the object from the matching lister.
+func waitForObject(ctx context.Context, informer cache.SharedIndexInformer, name string, check func() (bool, error)) error {
+	changed := make(chan struct{}, 1)
+	notify := func(obj interface{}) {
+		// Tombstones have no accessor, so they always trigger a re-check.
+		if m, err := meta.Accessor(obj); err == nil && m.GetName() != name {
+			return
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	registration, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, newObj interface{}) { notify(newObj) },
+		DeleteFunc: notify,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch %s", name)
+	}
+	defer func() {
+		_ = informer.RemoveEventHandler(registration)
+	}()
+
+	// Check only after the handler is registered so no change can slip by.
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "timed out waiting for %s", name)
+		case <-changed:
+		}
+	}
+}
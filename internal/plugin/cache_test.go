@@ -0,0 +1,129 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+	lhfake "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhscheme "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned/scheme"
+)
+
+// benchmarkVolumes is the number of volumes, each with one snapshot, the
+// cache benchmarks run against.
+const benchmarkVolumes = 1000
+
+// newFakeLonghornClient returns a longhornClient backed by fake Kubernetes and
+// Longhorn clientsets, each seeded with the objects of its kind.
+func newFakeLonghornClient(objects ...runtime.Object) (*longhornClient, *lhfake.Clientset) {
+	var k8sObjects, lhObjects []runtime.Object
+	for _, obj := range objects {
+		if _, _, err := lhscheme.Scheme.ObjectKinds(obj); err == nil {
+			lhObjects = append(lhObjects, obj)
+		} else {
+			k8sObjects = append(k8sObjects, obj)
+		}
+	}
+	lh := lhfake.NewSimpleClientset(lhObjects...)
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	return &longhornClient{
+		k8s:     k8sfake.NewSimpleClientset(k8sObjects...),
+		lh:      lh,
+		log:     log,
+		timeout: defaultAPITimeout,
+		backoff: defaultAPIBackoff,
+	}, lh
+}
+
+// newFakeLonghornCache returns a synced cache of the Longhorn CRs of client,
+// stopped at the end of the test.
+func newFakeLonghornCache(t testing.TB, client *longhornClient) *longhornCache {
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	lhCache, err := newLonghornCache(client, stopCh)
+	require.NoError(t, err)
+	return lhCache
+}
+
+// benchmarkObjects returns n Volumes with one Snapshot each.
+func benchmarkObjects(n int) []runtime.Object {
+	objects := make([]runtime.Object, 0, 2*n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("pvc-%04d", i)
+		objects = append(objects,
+			&longhorn.Volume{
+				ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: name},
+				Spec:       longhorn.VolumeSpec{Size: 1 << 30, NumberOfReplicas: 3},
+			},
+			&longhorn.Snapshot{
+				ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "snap-" + name},
+				Spec:       longhorn.SnapshotSpec{Volume: name},
+			},
+		)
+	}
+	return objects
+}
+
+// BenchmarkNewLonghornCache measures the initial sync of the cache. It costs
+// one LIST and WATCH per kind however many volumes there are.
+func BenchmarkNewLonghornCache(b *testing.B) {
+	objects := benchmarkObjects(benchmarkVolumes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, lh := newFakeLonghornClient(objects...)
+		stopCh := make(chan struct{})
+		_, err := newLonghornCache(client, stopCh)
+		close(stopCh)
+		require.NoError(b, err)
+		b.ReportMetric(float64(len(lh.Actions())), "api-calls/sync")
+	}
+}
+
+// BenchmarkVolumeAdditionalItems measures the per-volume overhead of the
+// backup action once the cache is synced: the lookups it makes for every PV
+// and PVC are served from memory, with no API calls.
+func BenchmarkVolumeAdditionalItems(b *testing.B) {
+	client, lh := newFakeLonghornClient(benchmarkObjects(benchmarkVolumes)...)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	lhCache, err := newLonghornCache(client, stopCh)
+	require.NoError(b, err)
+	p := &BackupPluginV2{log: client.log, client: client, cache: lhCache}
+	synced := len(lh.Actions())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		items, err := p.volumeAdditionalItems(fmt.Sprintf("pvc-%04d", i%benchmarkVolumes), nil)
+		require.NoError(b, err)
+		require.NotEmpty(b, items)
+		snapshot, err := lhCache.snapshots.Get(fmt.Sprintf("snap-pvc-%04d", i%benchmarkVolumes))
+		require.NoError(b, err)
+		require.NotNil(b, snapshot)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(len(lh.Actions())-synced)/float64(b.N), "api-calls/volume")
+}
@@ -0,0 +1,410 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// capacityCheckConfigKey sets what happens when a volume restored from a
+	// Longhorn backup or a Velero native snapshot does not fit on the disks
+	// of the cluster: "warn" (the default) logs it, "fail" fails its restore
+	// before anything is created, and "disabled" skips the check.
+	capacityCheckConfigKey = "capacityCheck"
+
+	capacityCheckWarn     = "warn"
+	capacityCheckFail     = "fail"
+	capacityCheckDisabled = "disabled"
+
+	settingNameDefaultReplicaCount        = "default-replica-count"
+	settingNameOverProvisioningPercentage = "storage-over-provisioning-percentage"
+	settingNameMinimalAvailablePercentage = "storage-minimal-available-percentage"
+	defaultReplicaCount                   = 3
+	defaultOverProvisioningPercentage     = 100
+	defaultMinimalAvailablePercentage     = 25
+)
+
+// capacitySettings are the Longhorn settings replica scheduling depends on.
+type capacitySettings struct {
+	defaultReplicas  int64
+	overProvisioning int64
+	minimalAvailable int64
+}
+
+// capacityRequest is the room a volume needs: a replica of size bytes on
+// each of replicas nodes, on nodes and disks matching its selectors.
+type capacityRequest struct {
+	volumeName   string
+	size         int64
+	replicas     int64
+	nodeSelector []string
+	diskSelector []string
+}
+
+// capacityReservation is the room on the disks of the cluster taken by the
+// replicas of a volume the plugin created, until Longhorn schedules them
+// and counts them itself.
+type capacityReservation struct {
+	volumeName string
+	size       int64
+	disks      []string
+}
+
+// diskRoom is the room a node has for a replica, on its roomiest eligible disk.
+type diskRoom struct {
+	disk string
+	room int64
+}
+
+var (
+	// reservationsLock guards reservations, which the restore item action and
+	// the volume snapshotter serving the same restore share.
+	reservationsLock sync.Mutex
+	reservations     []capacityReservation
+)
+
+// capacityCheckMode returns the capacityCheck mode set in config.
+func capacityCheckMode(config map[string]string) (string, error) {
+	switch mode := config[capacityCheckConfigKey]; mode {
+	case "":
+		return capacityCheckWarn, nil
+	case capacityCheckWarn, capacityCheckFail, capacityCheckDisabled:
+		return mode, nil
+	default:
+		return "", errors.Errorf("invalid %s %q: must be %s, %s or %s", capacityCheckConfigKey, mode,
+			capacityCheckWarn, capacityCheckFail, capacityCheckDisabled)
+	}
+}
+
+// intSettingValue returns the value of a numeric Longhorn setting, or def if
+// it is not set. A data engine specific value gives the one of the v1 engine.
+func (c *longhornClient) intSettingValue(name string, def int64) (int64, error) {
+	v, err := c.getSettingValue(name)
+	if err != nil || v == "" {
+		return def, err
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n, nil
+	}
+	perEngine := map[string]string{}
+	if err := json.Unmarshal([]byte(v), &perEngine); err == nil {
+		if n, err := strconv.ParseInt(perEngine[string(longhorn.DataEngineTypeV1)], 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, errors.Errorf("invalid value %q of Longhorn setting %s", v, name)
+}
+
+// capacitySettings reads the Longhorn settings replica scheduling depends on.
+func (c *longhornClient) capacitySettings() (capacitySettings, error) {
+	var settings capacitySettings
+	var err error
+	if settings.defaultReplicas, err = c.intSettingValue(settingNameDefaultReplicaCount, defaultReplicaCount); err != nil {
+		return settings, err
+	}
+	if settings.overProvisioning, err = c.intSettingValue(settingNameOverProvisioningPercentage, defaultOverProvisioningPercentage); err != nil {
+		return settings, err
+	}
+	settings.minimalAvailable, err = c.intSettingValue(settingNameMinimalAvailablePercentage, defaultMinimalAvailablePercentage)
+	return settings, err
+}
+
+// volumeCapacityRequest returns the room volume needs.
+func volumeCapacityRequest(volume *longhorn.Volume, settings capacitySettings) capacityRequest {
+	replicas := int64(volume.Spec.NumberOfReplicas)
+	if replicas == 0 {
+		replicas = settings.defaultReplicas
+	}
+	return capacityRequest{
+		volumeName:   volume.Name,
+		size:         volume.Spec.Size,
+		replicas:     replicas,
+		nodeSelector: volume.Spec.NodeSelector,
+		diskSelector: volume.Spec.DiskSelector,
+	}
+}
+
+// planCapacity places the replicas of each request in turn, the way
+// Longhorn schedules them: one replica per node, on a disk with more than
+// the minimal available storage left and with the replica fitting under its
+// over-provisioned maximum. Replicas go to the roomiest disks, where
+// Longhorn is most likely to put them. reserved is the room already taken on
+// each disk, keyed by "<node>/<disk>", and is left unchanged. It returns the
+// reservations of the requests that fit and the requests that do not.
+func planCapacity(nodes []*longhorn.Node, settings capacitySettings, reserved map[string]int64, requests []capacityRequest) ([]capacityReservation, []capacityRequest) {
+	taken := make(map[string]int64, len(reserved))
+	for disk, size := range reserved {
+		taken[disk] = size
+	}
+
+	var planned []capacityReservation
+	var unfit []capacityRequest
+	for _, request := range requests {
+		var fits []diskRoom
+		for _, node := range nodes {
+			if !node.Spec.AllowScheduling || node.Spec.EvictionRequested || !hasTags(node.Spec.Tags, request.nodeSelector) {
+				continue
+			}
+			best := diskRoom{room: -1}
+			for name, disk := range node.Spec.Disks {
+				status := node.Status.DiskStatus[name]
+				if status == nil || !disk.AllowScheduling || disk.EvictionRequested || !hasTags(disk.Tags, request.diskSelector) ||
+					!isDiskSchedulable(status) || status.StorageAvailable <= status.StorageMaximum*settings.minimalAvailable/100 {
+					continue
+				}
+				key := node.Name + "/" + name
+				room := (status.StorageMaximum-disk.StorageReserved)*settings.overProvisioning/100 - status.StorageScheduled - taken[key]
+				if room > best.room || (room == best.room && key < best.disk) {
+					best = diskRoom{disk: key, room: room}
+				}
+			}
+			if best.room >= request.size {
+				fits = append(fits, best)
+			}
+		}
+		if int64(len(fits)) < request.replicas {
+			unfit = append(unfit, request)
+			continue
+		}
+
+		sort.Slice(fits, func(i, j int) bool {
+			if fits[i].room != fits[j].room {
+				return fits[i].room > fits[j].room
+			}
+			return fits[i].disk < fits[j].disk
+		})
+		reservation := capacityReservation{volumeName: request.volumeName, size: request.size}
+		for _, fit := range fits[:request.replicas] {
+			reservation.disks = append(reservation.disks, fit.disk)
+			taken[fit.disk] += request.size
+		}
+		planned = append(planned, reservation)
+	}
+	return planned, unfit
+}
+
+// checkVolumeCapacity checks that the disks of the cluster have room for
+// every replica of volume before it is created and, if they do, reserves it
+// until Longhorn schedules the replicas. The room reserved for the volumes
+// created before is taken into account. Depending on mode, a volume that
+// does not fit is logged or fails with an error.
+func (c *longhornClient) checkVolumeCapacity(cache *longhornCache, volume *longhorn.Volume, mode string) error {
+	if mode == capacityCheckDisabled {
+		return nil
+	}
+	// A retried restore already counted an existing volume.
+	if _, err := cache.volumes.Get(volume.Name); err == nil {
+		return nil
+	} else if !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get volume %s", volume.Name)
+	}
+	settings, err := c.capacitySettings()
+	if err != nil {
+		return err
+	}
+
+	reservationsLock.Lock()
+	defer reservationsLock.Unlock()
+	reserved, err := reservedCapacity(cache)
+	if err != nil {
+		return err
+	}
+	nodes, err := cache.nodes.List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "failed to list nodes")
+	}
+
+	request := volumeCapacityRequest(volume, settings)
+	planned, _ := planCapacity(nodes, settings, reserved, []capacityRequest{request})
+	if len(planned) == 0 {
+		msg := "Longhorn volume %s needs %d replicas of %d bytes, but not enough nodes have room for one"
+		if mode == capacityCheckFail {
+			return errors.Errorf(msg, volume.Name, request.replicas, request.size)
+		}
+		c.log.WithField("volume", volume.Name).Warnf(msg, volume.Name, request.replicas, request.size)
+		return nil
+	}
+	reservations = append(reservations, planned...)
+	return nil
+}
+
+// reservedCapacity returns the room reserved on each disk by the volumes the
+// plugin created, dropping the reservations of volumes Longhorn has
+// scheduled and so counts in the scheduled storage of their disks.
+// The caller holds reservationsLock.
+func reservedCapacity(cache *longhornCache) (map[string]int64, error) {
+	reserved := map[string]int64{}
+	kept := reservations[:0]
+	for _, reservation := range reservations {
+		vol, err := cache.volumes.Get(reservation.volumeName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "failed to get volume %s", reservation.volumeName)
+		}
+		if vol != nil && (vol.Status.Robustness == longhorn.VolumeRobustnessHealthy || vol.Status.Robustness == longhorn.VolumeRobustnessDegraded) {
+			continue
+		}
+		kept = append(kept, reservation)
+		for _, disk := range reservation.disks {
+			reserved[disk] += reservation.size
+		}
+	}
+	reservations = kept
+	return reserved, nil
+}
+
+// checkCapacity checks the capacity for volume, restored from a Longhorn
+// backup by restore. Before the first volume of the restore is created, a
+// preflight sums the room all of them need; with capacityCheck set to
+// "fail", the volumes the preflight found no room for fail even if they
+// would fit on their own, since they would only fit by starving the others.
+func (p *RestorePluginV2) checkCapacity(volume *longhorn.Volume, restore *v1.Restore) error {
+	mode, err := capacityCheckMode(p.config)
+	if err != nil || mode == capacityCheckDisabled {
+		return err
+	}
+	unfit, err := p.preflightCapacity(restore)
+	if err != nil {
+		return err
+	}
+	if sourceVolume := volume.Labels[sourceVolumeLabel]; unfit[sourceVolume] && mode == capacityCheckFail {
+		return errors.Errorf("Longhorn volume %s restoring %s does not fit on the disks of the cluster with the other volumes of restore %s",
+			volume.Name, sourceVolume, restore.Name)
+	}
+	return p.client.checkVolumeCapacity(p.cache, volume, mode)
+}
+
+// preflightCapacity sums the room needed by the volumes of every Longhorn
+// backup the Velero backup of restore took, on top of the room already
+// reserved, and logs a summary of those that do not fit. It runs once per
+// restore and returns the names of the backed up volumes that do not fit.
+// The replicas of each volume are counted with the default replica count,
+// since the backups do not record it.
+func (p *RestorePluginV2) preflightCapacity(restore *v1.Restore) (map[string]bool, error) {
+	p.preflightsLock.Lock()
+	defer p.preflightsLock.Unlock()
+	if unfit, ok := p.preflights[restore.UID]; ok {
+		return unfit, nil
+	}
+
+	settings, err := p.client.capacitySettings()
+	if err != nil {
+		return nil, err
+	}
+	requests, err := p.cache.restoreCapacityRequests(restore.Spec.BackupName, settings)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := p.cache.nodes.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list nodes")
+	}
+	reservationsLock.Lock()
+	reserved, err := reservedCapacity(p.cache)
+	reservationsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	_, unfitRequests := planCapacity(nodes, settings, reserved, requests)
+	unfit := map[string]bool{}
+	var total int64
+	for _, request := range requests {
+		total += request.size * request.replicas
+	}
+	log := p.log.WithField("restore", restore.Name)
+	if len(unfitRequests) == 0 {
+		log.Infof("The %d Longhorn volumes of backup %s fit on the disks of the cluster, %d bytes with their replicas",
+			len(requests), restore.Spec.BackupName, total)
+	} else {
+		summary := make([]string, 0, len(unfitRequests))
+		for _, request := range unfitRequests {
+			unfit[request.volumeName] = true
+			summary = append(summary, fmt.Sprintf("%s (%d replicas of %d bytes)", request.volumeName, request.replicas, request.size))
+		}
+		log.Warnf("%d of the %d Longhorn volumes of backup %s, %d bytes with their replicas, do not fit on the disks of the cluster: %s",
+			len(unfitRequests), len(requests), restore.Spec.BackupName, total, strings.Join(summary, ", "))
+	}
+
+	if p.preflights == nil {
+		p.preflights = map[types.UID]map[string]bool{}
+	}
+	p.preflights[restore.UID] = unfit
+	return unfit, nil
+}
+
+// restoreCapacityRequests returns the room needed to restore the volumes of
+// the completed Longhorn backups the Velero backup backupName took, the
+// largest first.
+func (c *longhornCache) restoreCapacityRequests(backupName string, settings capacitySettings) ([]capacityRequest, error) {
+	backups, err := c.backups.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list backups")
+	}
+	// Backups synced from the backup target only carry their labels in their status.
+	name := label.GetValidName(backupName)
+	seen := map[string]bool{}
+	var requests []capacityRequest
+	for _, backup := range backups {
+		if backup.Labels[v1.BackupNameLabel] != name && backup.Status.Labels[v1.BackupNameLabel] != name {
+			continue
+		}
+		volumeName := backup.Status.VolumeName
+		if volumeName == "" {
+			volumeName = backup.Labels[backupVolumeLabel]
+		}
+		if backup.Status.State != longhorn.BackupStateCompleted || volumeName == "" || seen[volumeName] {
+			continue
+		}
+		seen[volumeName] = true
+		size, _ := strconv.ParseInt(backup.Status.VolumeSize, 10, 64)
+		requests = append(requests, capacityRequest{volumeName: volumeName, size: size, replicas: settings.defaultReplicas})
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].size != requests[j].size {
+			return requests[i].size > requests[j].size
+		}
+		return requests[i].volumeName < requests[j].volumeName
+	})
+	return requests, nil
+}
+
+// isDiskSchedulable reports whether Longhorn considers the disk schedulable.
+func isDiskSchedulable(status *longhorn.DiskStatus) bool {
+	for _, condition := range status.Conditions {
+		if condition.Type == longhorn.DiskConditionTypeSchedulable {
+			return condition.Status == longhorn.ConditionStatusTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const gi = int64(1) << 30
+
+// testDisk describes a disk of a test node, with sizes in GiB.
+type testDisk struct {
+	name                                   string
+	maximum, available, scheduled, reserve int64
+	tags                                   []string
+	unschedulable                          bool
+}
+
+// testNode returns a schedulable Longhorn Node CR with the given disks.
+func testNode(name string, tags []string, disks ...testDisk) *longhorn.Node {
+	node := &longhorn.Node{
+		ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: name},
+		Spec: longhorn.NodeSpec{
+			AllowScheduling: true,
+			Tags:            tags,
+			Disks:           map[string]longhorn.DiskSpec{},
+		},
+		Status: longhorn.NodeStatus{DiskStatus: map[string]*longhorn.DiskStatus{}},
+	}
+	for _, disk := range disks {
+		schedulable := longhorn.ConditionStatusTrue
+		if disk.unschedulable {
+			schedulable = longhorn.ConditionStatusFalse
+		}
+		node.Spec.Disks[disk.name] = longhorn.DiskSpec{
+			AllowScheduling: true,
+			StorageReserved: disk.reserve * gi,
+			Tags:            disk.tags,
+		}
+		node.Status.DiskStatus[disk.name] = &longhorn.DiskStatus{
+			StorageMaximum:   disk.maximum * gi,
+			StorageAvailable: disk.available * gi,
+			StorageScheduled: disk.scheduled * gi,
+			Conditions: []longhorn.Condition{
+				{Type: longhorn.DiskConditionTypeSchedulable, Status: schedulable},
+			},
+		}
+	}
+	return node
+}
+
+func TestPlanCapacity(t *testing.T) {
+	defaults := capacitySettings{defaultReplicas: 3, overProvisioning: 100, minimalAvailable: 25}
+	empty := testDisk{name: "disk-1", maximum: 100, available: 100}
+	threeNodes := []*longhorn.Node{
+		testNode("node-1", nil, empty),
+		testNode("node-2", nil, empty),
+		testNode("node-3", nil, empty),
+	}
+	unschedulableNode := testNode("node-3", nil, empty)
+	unschedulableNode.Spec.AllowScheduling = false
+
+	tests := []struct {
+		name        string
+		nodes       []*longhorn.Node
+		settings    capacitySettings
+		reserved    map[string]int64
+		requests    []capacityRequest
+		wantPlanned []capacityReservation
+		wantUnfit   []string
+	}{
+		{
+			name:     "one replica on each node",
+			nodes:    threeNodes,
+			settings: defaults,
+			requests: []capacityRequest{{volumeName: "vol-1", size: 10 * gi, replicas: 3}},
+			wantPlanned: []capacityReservation{
+				{volumeName: "vol-1", size: 10 * gi, disks: []string{"node-1/disk-1", "node-2/disk-1", "node-3/disk-1"}},
+			},
+		},
+		{
+			name:      "more replicas than nodes",
+			nodes:     threeNodes[:2],
+			settings:  defaults,
+			requests:  []capacityRequest{{volumeName: "vol-1", size: 10 * gi, replicas: 3}},
+			wantUnfit: []string{"vol-1"},
+		},
+		{
+			name:      "unschedulable node",
+			nodes:     []*longhorn.Node{threeNodes[0], threeNodes[1], unschedulableNode},
+			settings:  defaults,
+			requests:  []capacityRequest{{volumeName: "vol-1", size: 10 * gi, replicas: 3}},
+			wantUnfit: []string{"vol-1"},
+		},
+		{
+			name:      "unschedulable disk",
+			nodes:     []*longhorn.Node{testNode("node-1", nil, testDisk{name: "disk-1", maximum: 100, available: 100, unschedulable: true})},
+			settings:  defaults,
+			requests:  []capacityRequest{{volumeName: "vol-1", size: 10 * gi, replicas: 1}},
+			wantUnfit: []string{"vol-1"},
+		},
+		{
+			name:      "disk at the minimal available storage",
+			nodes:     []*longhorn.Node{testNode("node-1", nil, testDisk{name: "disk-1", maximum: 100, available: 25})},
+			settings:  defaults,
+			requests:  []capacityRequest{{volumeName: "vol-1", size: 1 * gi, replicas: 1}},
+			wantUnfit: []string{"vol-1"},
+		},
+		{
+			name:      "reserved storage is not schedulable",
+			nodes:     []*longhorn.Node{testNode("node-1", nil, testDisk{name: "disk-1", maximum: 100, available: 100, reserve: 30})},
+			settings:  defaults,
+			requests:  []capacityRequest{{volumeName: "vol-1", size: 80 * gi, replicas: 1}},
+			wantUnfit: []string{"vol-1"},
+		},
+		{
+			name:     "over-provisioning",
+			nodes:    []*longhorn.Node{testNode("node-1", nil, testDisk{name: "disk-1", maximum: 100, available: 60, scheduled: 150})},
+			settings: capacitySettings{defaultReplicas: 3, overProvisioning: 200, minimalAvailable: 25},
+			requests: []capacityRequest{{volumeName: "vol-1", size: 50 * gi, replicas: 1}},
+			wantPlanned: []capacityReservation{
+				{volumeName: "vol-1", size: 50 * gi, disks: []string{"node-1/disk-1"}},
+			},
+		},
+		{
+			name:      "room reserved by earlier volumes",
+			nodes:     threeNodes,
+			settings:  defaults,
+			reserved:  map[string]int64{"node-3/disk-1": 95 * gi},
+			requests:  []capacityRequest{{volumeName: "vol-1", size: 10 * gi, replicas: 3}},
+			wantUnfit: []string{"vol-1"},
+		},
+		{
+			name:     "requests share the room",
+			nodes:    []*longhorn.Node{testNode("node-1", nil, empty)},
+			settings: defaults,
+			requests: []capacityRequest{
+				{volumeName: "vol-1", size: 60 * gi, replicas: 1},
+				{volumeName: "vol-2", size: 60 * gi, replicas: 1},
+				{volumeName: "vol-3", size: 40 * gi, replicas: 1},
+			},
+			wantPlanned: []capacityReservation{
+				{volumeName: "vol-1", size: 60 * gi, disks: []string{"node-1/disk-1"}},
+				{volumeName: "vol-3", size: 40 * gi, disks: []string{"node-1/disk-1"}},
+			},
+			wantUnfit: []string{"vol-2"},
+		},
+		{
+			name: "roomiest disk of each node and roomiest nodes",
+			nodes: []*longhorn.Node{
+				testNode("node-1", nil,
+					testDisk{name: "disk-a", maximum: 100, available: 100, scheduled: 50},
+					testDisk{name: "disk-b", maximum: 100, available: 100, scheduled: 20}),
+				testNode("node-2", nil, testDisk{name: "disk-1", maximum: 100, available: 100, scheduled: 90}),
+				testNode("node-3", nil, testDisk{name: "disk-1", maximum: 100, available: 100, scheduled: 10}),
+			},
+			settings: defaults,
+			requests: []capacityRequest{{volumeName: "vol-1", size: 5 * gi, replicas: 2}},
+			wantPlanned: []capacityReservation{
+				{volumeName: "vol-1", size: 5 * gi, disks: []string{"node-3/disk-1", "node-1/disk-b"}},
+			},
+		},
+		{
+			name: "node and disk selectors",
+			nodes: []*longhorn.Node{
+				testNode("node-1", []string{"ssd"}, testDisk{name: "disk-1", maximum: 100, available: 100, tags: []string{"fast"}}),
+				testNode("node-2", []string{"ssd"}, empty),
+				testNode("node-3", nil, testDisk{name: "disk-1", maximum: 100, available: 100, tags: []string{"fast"}}),
+			},
+			settings: defaults,
+			requests: []capacityRequest{
+				{volumeName: "vol-1", size: 10 * gi, replicas: 1, nodeSelector: []string{"ssd"}, diskSelector: []string{"fast"}},
+				{volumeName: "vol-2", size: 10 * gi, replicas: 2, nodeSelector: []string{"ssd"}, diskSelector: []string{"fast"}},
+			},
+			wantPlanned: []capacityReservation{
+				{volumeName: "vol-1", size: 10 * gi, disks: []string{"node-1/disk-1"}},
+			},
+			wantUnfit: []string{"vol-2"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reserved := map[string]int64{}
+			for disk, size := range tc.reserved {
+				reserved[disk] = size
+			}
+			planned, unfit := planCapacity(tc.nodes, tc.settings, reserved, tc.requests)
+			assert.Equal(t, tc.wantPlanned, planned)
+			var unfitNames []string
+			for _, request := range unfit {
+				unfitNames = append(unfitNames, request.volumeName)
+			}
+			assert.Equal(t, tc.wantUnfit, unfitNames)
+			if tc.reserved != nil {
+				assert.Equal(t, tc.reserved, reserved)
+			}
+		})
+	}
+}
+
+func TestIntSettingValue(t *testing.T) {
+	setting := func(name, value string) *longhorn.Setting {
+		return &longhorn.Setting{ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: name}, Value: value}
+	}
+	client, _ := newFakeLonghornClient(
+		setting("plain", "200"),
+		setting("per-engine", `{"v1":"150","v2":"100"}`),
+		setting("empty", ""),
+		setting("invalid", "lots"),
+	)
+
+	tests := []struct {
+		name    string
+		want    int64
+		wantErr bool
+	}{
+		{name: "plain", want: 200},
+		{name: "per-engine", want: 150},
+		{name: "empty", want: 7},
+		{name: "missing", want: 7},
+		{name: "invalid", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := client.intSettingValue(tc.name, 7)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRestoreCapacityRequests(t *testing.T) {
+	const target = "s3://backups@us-east-1/"
+	backup := func(name, volumeName, size string, state longhorn.BackupState) *longhorn.Backup {
+		b := testBackup(target, name, volumeName, state, "2026-01-01T00:00:00Z")
+		b.Status.VolumeSize = size
+		return b
+	}
+	local := backup("backup-1", "pvc-1", "10737418240", longhorn.BackupStateCompleted)
+	local.Labels[v1.BackupNameLabel] = "nightly"
+	synced := backup("backup-2", "pvc-2", "21474836480", longhorn.BackupStateCompleted)
+	synced.Status.Labels = map[string]string{v1.BackupNameLabel: "nightly"}
+	small := backup("backup-3", "pvc-3", "10737418240", longhorn.BackupStateCompleted)
+	small.Labels[v1.BackupNameLabel] = "nightly"
+	inProgress := backup("backup-4", "pvc-4", "10737418240", longhorn.BackupStateInProgress)
+	inProgress.Labels[v1.BackupNameLabel] = "nightly"
+	other := backup("backup-5", "pvc-5", "10737418240", longhorn.BackupStateCompleted)
+	other.Labels[v1.BackupNameLabel] = "weekly"
+
+	client, _ := newFakeLonghornClient(local, synced, small, inProgress, other)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	lhCache, err := newLonghornCache(client, stopCh)
+	require.NoError(t, err)
+
+	requests, err := lhCache.restoreCapacityRequests("nightly", capacitySettings{defaultReplicas: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []capacityRequest{
+		{volumeName: "pvc-2", size: 20 * gi, replicas: 2},
+		{volumeName: "pvc-1", size: 10 * gi, replicas: 2},
+		{volumeName: "pvc-3", size: 10 * gi, replicas: 2},
+	}, requests)
+}
@@ -0,0 +1,194 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+
+	lhclientset "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned"
+)
+
+const (
+	// longhornNamespace is the namespace Longhorn keeps its CRs in.
+	longhornNamespace = "longhorn-system"
+
+	// apiTimeoutConfigKey overrides the deadline of a single API call.
+	apiTimeoutConfigKey = "apiTimeout"
+	// apiRetriesConfigKey overrides how many times a retriable API call is attempted.
+	apiRetriesConfigKey = "apiRetries"
+
+	defaultAPITimeout = 30 * time.Second
+)
+
+// defaultAPIBackoff is the backoff used between attempts of a retriable API call.
+var defaultAPIBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 500 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+	Cap:      10 * time.Second,
+}
+
+// longhornClient wraps the Kubernetes and Longhorn clientsets so that every
+// call the plugins make gets its own deadline and is retried with exponential
+// backoff when the API server reports a transient failure.
+type longhornClient struct {
+	k8s kubernetes.Interface
+	lh  lhclientset.Interface
+	dyn dynamic.Interface
+	log logrus.FieldLogger
+
+	timeout time.Duration
+	backoff wait.Backoff
+}
+
+// newLonghornClient builds a longhornClient from the in-cluster config, with
+// the call deadline and retry count optionally overridden by the plugin config.
+func newLonghornClient(log logrus.FieldLogger, config map[string]string) (*longhornClient, error) {
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching cluster config")
+	}
+
+	k8sClient, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create k8s client")
+	}
+
+	lhClient, err := lhclientset.NewForConfig(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create longhorn client")
+	}
+
+	dynClient, err := dynamic.NewForConfig(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	c := &longhornClient{
+		k8s:     k8sClient,
+		lh:      lhClient,
+		dyn:     dynClient,
+		log:     log,
+		timeout: defaultAPITimeout,
+		backoff: defaultAPIBackoff,
+	}
+	if err := c.configure(config); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configure applies the API call settings found in the plugin config.
+func (c *longhornClient) configure(config map[string]string) error {
+	timeout, err := durationConfig(config, apiTimeoutConfigKey, defaultAPITimeout)
+	if err != nil {
+		return err
+	}
+	c.timeout = timeout
+	if v := config[apiRetriesConfigKey]; v != "" {
+		steps, err := strconv.Atoi(v)
+		if err != nil || steps <= 0 {
+			return errors.Errorf("invalid %s %q: must be a positive integer", apiRetriesConfigKey, v)
+		}
+		c.backoff.Steps = steps
+	}
+	return nil
+}
+
+// call runs fn with a fresh per-attempt deadline, retrying it with exponential
+// backoff while it fails with a retriable error. The op string describes the
+// call, e.g. "create snapshot velero-snap-xxx", and prefixes the returned error.
+func (c *longhornClient) call(op string, fn func(ctx context.Context) error) error {
+	attempt := 0
+	err := retry.OnError(c.backoff, isRetriableError, func() error {
+		attempt++
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+
+		err := fn(ctx)
+		if err != nil && isRetriableError(err) && attempt < c.backoff.Steps {
+			c.log.WithError(err).Warnf("Failed to %s on attempt %d, retrying", op, attempt)
+		}
+		return err
+	})
+	return classifyError(op, err, attempt)
+}
+
+// isRetriableError reports whether err is a transient failure worth another attempt.
+func isRetriableError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case apierrors.IsConflict(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsTooManyRequests(err),
+		apierrors.IsServiceUnavailable(err),
+		errors.Is(err, context.DeadlineExceeded):
+		return true
+	case isWebhookUnavailable(err):
+		return true
+	}
+	return false
+}
+
+// isWebhookUnavailable reports whether the API server could not reach the
+// Longhorn admission webhook, which happens while longhorn-manager restarts.
+func isWebhookUnavailable(err error) bool {
+	return apierrors.IsInternalError(err) && strings.Contains(err.Error(), "failed calling webhook")
+}
+
+// isWebhookDenied reports whether the Longhorn admission webhook rejected the request.
+func isWebhookDenied(err error) bool {
+	return strings.Contains(err.Error(), "admission webhook") && strings.Contains(err.Error(), "denied the request")
+}
+
+// classifyError wraps err with a message that explains what went wrong in
+// terms a Velero user can act on. The API error stays reachable as the cause.
+func classifyError(op string, err error, attempts int) error {
+	switch {
+	case err == nil:
+		return nil
+	case isRetriableError(err):
+		return errors.Wrapf(err, "failed to %s: still failing after %d attempts", op, attempts)
+	case isWebhookDenied(err):
+		return errors.Wrapf(err, "failed to %s: rejected by the Longhorn admission webhook", op)
+	case apierrors.IsNotFound(err):
+		return errors.Wrapf(err, "failed to %s: object not found", op)
+	case apierrors.IsAlreadyExists(err):
+		return errors.Wrapf(err, "failed to %s: object already exists", op)
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return errors.Wrapf(err, "failed to %s: access denied, check the RBAC permissions of the Velero service account", op)
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return errors.Wrapf(err, "failed to %s: request rejected as invalid", op)
+	}
+	return errors.Wrapf(err, "failed to %s", op)
+}
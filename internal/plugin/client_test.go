@@ -0,0 +1,115 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var volumesResource = schema.GroupResource{Group: "longhorn.io", Resource: "volumes"}
+
+func TestIsRetriableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "conflict", err: apierrors.NewConflict(volumesResource, "vol", errors.New("modified")), want: true},
+		{name: "server timeout", err: apierrors.NewServerTimeout(volumesResource, "get", 1), want: true},
+		{name: "timeout", err: apierrors.NewTimeoutError("timed out", 1), want: true},
+		{name: "too many requests", err: apierrors.NewTooManyRequests("slow down", 1), want: true},
+		{name: "service unavailable", err: apierrors.NewServiceUnavailable("unavailable"), want: true},
+		{name: "deadline exceeded", err: errors.Wrap(context.DeadlineExceeded, "get volume"), want: true},
+		{name: "webhook unavailable", err: apierrors.NewInternalError(errors.New(`failed calling webhook "validator.longhorn.io": connection refused`)), want: true},
+		{name: "other internal error", err: apierrors.NewInternalError(errors.New("boom")), want: false},
+		{name: "not found", err: apierrors.NewNotFound(volumesResource, "vol"), want: false},
+		{name: "forbidden", err: apierrors.NewForbidden(volumesResource, "vol", errors.New("no")), want: false},
+		{name: "plain error", err: errors.New("boom"), want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isRetriableError(tc.err))
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "retriable",
+			err:  apierrors.NewServiceUnavailable("unavailable"),
+			want: "failed to get volume vol: still failing after 5 attempts",
+		},
+		{
+			name: "webhook denied",
+			err:  apierrors.NewBadRequest(`admission webhook "validator.longhorn.io" denied the request: invalid size`),
+			want: "failed to get volume vol: rejected by the Longhorn admission webhook",
+		},
+		{
+			name: "not found",
+			err:  apierrors.NewNotFound(volumesResource, "vol"),
+			want: "failed to get volume vol: object not found",
+		},
+		{
+			name: "already exists",
+			err:  apierrors.NewAlreadyExists(volumesResource, "vol"),
+			want: "failed to get volume vol: object already exists",
+		},
+		{
+			name: "forbidden",
+			err:  apierrors.NewForbidden(volumesResource, "vol", errors.New("no")),
+			want: "failed to get volume vol: access denied, check the RBAC permissions of the Velero service account",
+		},
+		{
+			name: "unauthorized",
+			err:  apierrors.NewUnauthorized("who are you"),
+			want: "failed to get volume vol: access denied, check the RBAC permissions of the Velero service account",
+		},
+		{
+			name: "bad request",
+			err:  apierrors.NewBadRequest("bad"),
+			want: "failed to get volume vol: request rejected as invalid",
+		},
+		{
+			name: "other",
+			err:  errors.New("boom"),
+			want: "failed to get volume vol",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classifyError("get volume vol", tc.err, 5)
+			assert.EqualError(t, err, fmt.Sprintf("%s: %s", tc.want, tc.err.Error()))
+			assert.Equal(t, tc.err, errors.Cause(err))
+		})
+	}
+
+	assert.NoError(t, classifyError("get volume vol", nil, 1))
+}
@@ -0,0 +1,114 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+)
+
+const (
+	// BackupPluginV2Name is the name the backup item action is registered under.
+	BackupPluginV2Name = "longhorn.io/backup-pluginv2"
+	// ResourceRestorePluginName is the name the Longhorn CR restore item action
+	// is registered under.
+	ResourceRestorePluginName = "longhorn.io/resource-restore-plugin"
+	// RestorePluginV2Name is the name the PVC restore item action is registered under.
+	RestorePluginV2Name = "longhorn.io/restore-pluginv2"
+	// PodRestorePluginName is the name the pod restore item action is registered under.
+	PodRestorePluginName = "longhorn.io/pod-restore-plugin"
+
+	veleroNamespaceEnv     = "VELERO_NAMESPACE"
+	defaultVeleroNamespace = "velero"
+)
+
+// veleroNamespace returns the namespace Velero, and so the plugin, runs in.
+func veleroNamespace() string {
+	if ns := os.Getenv(veleroNamespaceEnv); ns != "" {
+		return ns
+	}
+	return defaultVeleroNamespace
+}
+
+// getPluginConfig returns the data of the ConfigMap that configures the named
+// item action, following Velero's plugin config convention: a ConfigMap in
+// the Velero namespace labelled velero.io/plugin-config and <name>: <kind>.
+// It returns an empty map when there is no such ConfigMap.
+func (c *longhornClient) getPluginConfig(kind common.PluginKind, name string) (map[string]string, error) {
+	var configMap *corev1api.ConfigMap
+	err := c.call("get plugin config of "+name, func(ctx context.Context) error {
+		var err error
+		configMap, err = common.GetPluginConfig(kind, name, c.k8s.CoreV1().ConfigMaps(veleroNamespace()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if configMap == nil || configMap.Data == nil {
+		return map[string]string{}, nil
+	}
+	return configMap.Data, nil
+}
+
+// durationConfig reads a positive duration from the plugin config, falling
+// back to def when the key is not set.
+func durationConfig(config map[string]string, key string, def time.Duration) (time.Duration, error) {
+	v := config[key]
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid %s %q: must be a positive duration", key, v)
+	}
+	return d, nil
+}
+
+// boolConfig reads a boolean from the plugin config, falling back to def
+// when the key is not set.
+func boolConfig(config map[string]string, key string, def bool) (bool, error) {
+	v := config[key]
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.Errorf("invalid %s %q: must be true or false", key, v)
+	}
+	return b, nil
+}
+
+// listConfig reads a comma-separated list from the plugin config, ignoring
+// blank entries.
+func listConfig(config map[string]string, key string) []string {
+	var list []string
+	for _, v := range strings.Split(config[key], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,154 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// unhealthyVolumePolicy decides what happens when a volume to be snapshotted
+// is degraded, faulted or rebuilding.
+type unhealthyVolumePolicy string
+
+const (
+	// unhealthyVolumePolicyProceed snapshots the volume anyway.
+	unhealthyVolumePolicyProceed = unhealthyVolumePolicy("proceed")
+	// unhealthyVolumePolicyWait waits for the volume to become healthy and
+	// fails the snapshot if it does not within the wait timeout.
+	unhealthyVolumePolicyWait = unhealthyVolumePolicy("wait")
+	// unhealthyVolumePolicySkip leaves the volume out of the backup with a warning.
+	unhealthyVolumePolicySkip = unhealthyVolumePolicy("skip")
+	// unhealthyVolumePolicyFail fails the snapshot of the volume.
+	unhealthyVolumePolicyFail = unhealthyVolumePolicy("fail")
+
+	// unhealthyVolumePolicyConfigKey sets the policy for every volume in the VSL.
+	unhealthyVolumePolicyConfigKey = "unhealthyVolumePolicy"
+	// unhealthyVolumeWaitTimeoutConfigKey bounds the wait of the wait policy.
+	unhealthyVolumeWaitTimeoutConfigKey = "unhealthyVolumeWaitTimeout"
+	// unhealthyVolumePolicyAnnotation on a PVC overrides the VSL policy for its volume.
+	unhealthyVolumePolicyAnnotation = "velero.io/longhorn-unhealthy-volume-policy"
+
+	defaultUnhealthyVolumePolicy      = unhealthyVolumePolicyProceed
+	defaultUnhealthyVolumeWaitTimeout = 10 * time.Minute
+)
+
+// parseUnhealthyVolumePolicy validates a policy name, returning def for an empty one.
+func parseUnhealthyVolumePolicy(v string, def unhealthyVolumePolicy) (unhealthyVolumePolicy, error) {
+	switch policy := unhealthyVolumePolicy(v); policy {
+	case "":
+		return def, nil
+	case unhealthyVolumePolicyProceed, unhealthyVolumePolicyWait, unhealthyVolumePolicySkip, unhealthyVolumePolicyFail:
+		return policy, nil
+	}
+	return "", errors.Errorf("invalid unhealthy volume policy %q: must be one of %s, %s, %s or %s", v,
+		unhealthyVolumePolicyProceed, unhealthyVolumePolicyWait, unhealthyVolumePolicySkip, unhealthyVolumePolicyFail)
+}
+
+// volumeHealthProblem describes why vol is not safe to snapshot, or returns
+// an empty string if it is.
+func volumeHealthProblem(vol *longhorn.Volume) string {
+	switch vol.Status.Robustness {
+	case longhorn.VolumeRobustnessFaulted:
+		return "volume is faulted"
+	case longhorn.VolumeRobustnessDegraded:
+		return "volume is degraded or rebuilding replicas"
+	}
+	return ""
+}
+
+// applyUnhealthyVolumePolicy checks the health of the volume right before it
+// is snapshotted and carries out the policy if the volume is unhealthy.
+func (p *VolumeSnapshotter) applyUnhealthyVolumePolicy(volumeID string, policy unhealthyVolumePolicy) error {
+	vol, err := p.cache.volumes.Get(volumeID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get volume %s", volumeID)
+	}
+	problem := volumeHealthProblem(vol)
+	if problem == "" {
+		return nil
+	}
+
+	log := p.WithField("volume", volumeID).WithField("unhealthyVolumePolicy", policy)
+	switch policy {
+	case unhealthyVolumePolicyProceed:
+		log.Warnf("Snapshotting volume although %s", problem)
+		return nil
+	case unhealthyVolumePolicyWait:
+		log.Infof("Waiting up to %v for the volume to become healthy: %s", p.unhealthyVolumeWaitTimeout, problem)
+		ctx, cancel := context.WithTimeout(context.Background(), p.unhealthyVolumeWaitTimeout)
+		defer cancel()
+		err := waitForObject(ctx, p.cache.volumeInformer, volumeID, func() (bool, error) {
+			vol, err := p.cache.volumes.Get(volumeID)
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					return false, errors.Errorf("volume %s was deleted", volumeID)
+				}
+				return false, err
+			}
+			problem = volumeHealthProblem(vol)
+			return problem == "", nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "volume %s did not become healthy: %s", volumeID, problem)
+		}
+		log.Info("Volume became healthy, snapshotting it")
+		return nil
+	case unhealthyVolumePolicySkip:
+		// The volume was healthy when GetVolumeID decided to keep it in the
+		// backup; it is too late to skip it now.
+		return errors.Errorf("volume %s became unhealthy after it was selected for backup: %s", volumeID, problem)
+	}
+	log.Errorf("Refusing to snapshot volume: %s", problem)
+	return errors.Errorf("volume %s is not healthy: %s", volumeID, problem)
+}
+
+// volumeUnhealthyVolumePolicy returns the policy for the volume bound to pv:
+// the annotation on its PVC if set, the VSL policy otherwise.
+func (p *VolumeSnapshotter) volumeUnhealthyVolumePolicy(pv *corev1api.PersistentVolume) (unhealthyVolumePolicy, error) {
+	if pv.Spec.ClaimRef == nil {
+		return p.unhealthyVolumePolicy, nil
+	}
+	namespace, name := pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+
+	var pvc *corev1api.PersistentVolumeClaim
+	err := p.client.call("get PVC "+namespace+"/"+name, func(ctx context.Context) error {
+		var err error
+		pvc, err = p.client.k8s.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return p.unhealthyVolumePolicy, nil
+		}
+		return "", err
+	}
+
+	policy, err := parseUnhealthyVolumePolicy(pvc.Annotations[unhealthyVolumePolicyAnnotation], p.unhealthyVolumePolicy)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid %s annotation on PVC %s/%s", unhealthyVolumePolicyAnnotation, namespace, name)
+	}
+	return policy, nil
+}
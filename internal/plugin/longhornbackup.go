@@ -0,0 +1,192 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	biav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/backupitemaction/v2"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// backupVolumeLabel is the label Longhorn uses to tie a Backup CR to the
+// volume, and so the backup volume, it backs up.
+const backupVolumeLabel = "longhorn.io/backup-volume"
+
+// createSnapshot creates the Snapshot CR. The name is freshly generated by
+// the caller, so an AlreadyExists error means an earlier attempt that timed
+// out on our side did create it.
+func (c *longhornClient) createSnapshot(snapshot *longhorn.Snapshot) error {
+	return c.call("create snapshot "+snapshot.Name, func(ctx context.Context) error {
+		_, err := c.lh.LonghornV1beta2().Snapshots(longhornNamespace).Create(ctx, snapshot, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// createBackup creates a Backup CR of snapshotName on volumeName, with the
+// same AlreadyExists handling as createSnapshot.
+func (c *longhornClient) createBackup(name, volumeName, snapshotName string, labels map[string]string) error {
+	backup := &longhorn.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{backupVolumeLabel: volumeName},
+		},
+		Spec: longhorn.BackupSpec{
+			SnapshotName: snapshotName,
+			Labels:       labels,
+		},
+	}
+	for k, v := range labels {
+		backup.Labels[k] = v
+	}
+
+	return c.call("create backup "+name, func(ctx context.Context) error {
+		_, err := c.lh.LonghornV1beta2().Backups(longhornNamespace).Create(ctx, backup, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// getBackup returns the named Backup CR from cache or, like getVolume, from
+// the API server. It returns nil if there is no such backup.
+func (c *longhornClient) getBackup(cache *longhornCache, name string) (*longhorn.Backup, error) {
+	lhBackup, err := cache.backups.Get(name)
+	if err == nil {
+		return lhBackup, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "failed to get backup %s", name)
+	}
+	err = c.call("get backup "+name, func(ctx context.Context) error {
+		var err error
+		lhBackup, err = c.lh.LonghornV1beta2().Backups(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return lhBackup, err
+}
+
+// deleteSnapshot deletes the Snapshot CR, treating an already deleted one as success.
+func (c *longhornClient) deleteSnapshot(name string) error {
+	return c.call("delete snapshot "+name, func(ctx context.Context) error {
+		err := c.lh.LonghornV1beta2().Snapshots(longhornNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// deleteBackup deletes the Backup CR, and with it the backup in the backup
+// target, treating an already deleted one as success.
+func (c *longhornClient) deleteBackup(name string) error {
+	return c.call("delete backup "+name, func(ctx context.Context) error {
+		err := c.lh.LonghornV1beta2().Backups(longhornNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// releaseAttachmentTickets removes the given tickets from the volume's
+// VolumeAttachment, so Longhorn can detach a volume that was only attached
+// for our snapshot or backup. Missing tickets are ignored.
+func (c *longhornClient) releaseAttachmentTickets(volumeName string, ticketIDs ...string) error {
+	return c.call("release attachment tickets of volume "+volumeName, func(ctx context.Context) error {
+		va, err := c.lh.LonghornV1beta2().VolumeAttachments(longhornNamespace).Get(ctx, volumeName, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		released := false
+		for _, id := range ticketIDs {
+			if _, ok := va.Spec.AttachmentTickets[id]; ok {
+				delete(va.Spec.AttachmentTickets, id)
+				released = true
+			}
+		}
+		if !released {
+			return nil
+		}
+		_, err = c.lh.LonghornV1beta2().VolumeAttachments(longhornNamespace).Update(ctx, va, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// waitForSnapshotReady watches the snapshot until Longhorn marks it ready to
+// use, reports an error on it, or ctx expires.
+func (c *longhornCache) waitForSnapshotReady(ctx context.Context, snapshotName string) error {
+	return waitForObject(ctx, c.snapshotInformer, snapshotName, func() (bool, error) {
+		snapshot, err := c.snapshots.Get(snapshotName)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if snapshot.Status.Error != "" {
+			return false, errors.Errorf("snapshot %s failed: %s", snapshotName, snapshot.Status.Error)
+		}
+		return snapshot.Status.ReadyToUse, nil
+	})
+}
+
+// backupOperation identifies the Longhorn objects of an asynchronous backup
+// started by the backup item action for a PVC.
+type backupOperation struct {
+	pvcNamespace string
+	volumeName   string
+	snapshotName string
+	backupName   string
+}
+
+// String encodes the operation as the operation ID handed to Velero.
+func (o backupOperation) String() string {
+	return strings.Join([]string{o.pvcNamespace, o.volumeName, o.snapshotName, o.backupName}, "/")
+}
+
+// parseBackupOperation decodes an operation ID built by backupOperation.String.
+func parseBackupOperation(operationID string) (backupOperation, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 4 {
+		return backupOperation{}, biav2.InvalidOperationIDError(operationID)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return backupOperation{}, biav2.InvalidOperationIDError(operationID)
+		}
+	}
+	return backupOperation{pvcNamespace: parts[0], volumeName: parts[1], snapshotName: parts[2], backupName: parts[3]}, nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	biav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/backupitemaction/v2"
+)
+
+func TestParseBackupOperation(t *testing.T) {
+	tests := []struct {
+		name        string
+		operationID string
+		want        backupOperation
+		wantErr     bool
+	}{
+		{
+			name:        "valid",
+			operationID: "ns/pvc-1/velero-snap-abc/velero-backup-def",
+			want:        backupOperation{pvcNamespace: "ns", volumeName: "pvc-1", snapshotName: "velero-snap-abc", backupName: "velero-backup-def"},
+		},
+		{name: "empty", operationID: "", wantErr: true},
+		{name: "too few parts", operationID: "ns/pvc-1/velero-snap-abc", wantErr: true},
+		{name: "too many parts", operationID: "ns/pvc-1/velero-snap-abc/velero-backup-def/extra", wantErr: true},
+		{name: "empty part", operationID: "ns//velero-snap-abc/velero-backup-def", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			op, err := parseBackupOperation(tc.operationID)
+			if tc.wantErr {
+				assert.Equal(t, biav2.InvalidOperationIDError(tc.operationID), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, op)
+			assert.Equal(t, tc.operationID, op.String())
+		})
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// backupManifestLabel marks the ConfigMaps holding a backupManifest.
+	backupManifestLabel = "velero.io/longhorn-backup-manifest"
+	// backupManifestKey is the ConfigMap data key of the encoded manifest.
+	backupManifestKey = "manifest"
+
+	// backupManifestVersion is bumped whenever backupManifest changes incompatibly.
+	backupManifestVersion = "v1"
+
+	// Annotations set on a PVC in the Velero backup once the Longhorn backup
+	// of its data has finished.
+	longhornBackupNameAnnotation  = "velero.io/longhorn-backup-name"
+	longhornBackupURLAnnotation   = "velero.io/longhorn-backup-url"
+	longhornBackupStateAnnotation = "velero.io/longhorn-backup-state"
+)
+
+// backupManifest records where the data of a PVC went in the Longhorn backup
+// target, so a restore on any cluster can find the exact Longhorn backup.
+type backupManifest struct {
+	Version string `json:"version"`
+
+	PVCNamespace string `json:"pvcNamespace"`
+	PVCName      string `json:"pvcName"`
+	PVName       string `json:"pvName"`
+	VolumeName   string `json:"volumeName"`
+	SnapshotName string `json:"snapshotName"`
+	BackupName   string `json:"backupName"`
+
+	State                  longhorn.BackupState             `json:"state"`
+	URL                    string                           `json:"url,omitempty"`
+	Size                   string                           `json:"size,omitempty"`
+	CompressionMethod      longhorn.BackupCompressionMethod `json:"compressionMethod,omitempty"`
+	SnapshotCreatedAt      string                           `json:"snapshotCreatedAt,omitempty"`
+	VolumeBackingImageName string                           `json:"volumeBackingImageName,omitempty"`
+	BackupTargetName       string                           `json:"backupTargetName,omitempty"`
+}
+
+// setBackupStatus copies the Longhorn backup metadata into the manifest.
+func (m *backupManifest) setBackupStatus(lhBackup *longhorn.Backup) {
+	m.State = lhBackup.Status.State
+	m.URL = lhBackup.Status.URL
+	m.Size = lhBackup.Status.Size
+	m.CompressionMethod = lhBackup.Status.CompressionMethod
+	m.SnapshotCreatedAt = lhBackup.Status.SnapshotCreatedAt
+	m.VolumeBackingImageName = lhBackup.Status.VolumeBackingImageName
+	m.BackupTargetName = lhBackup.Status.BackupTargetName
+}
+
+// configMap returns the ConfigMap that stores the manifest in the PVC namespace
+// until the backup is finalized. It is named after the Longhorn backup, which
+// is unique.
+func (m *backupManifest) configMap(labels map[string]string) (*corev1api.ConfigMap, error) {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cm := &corev1api.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: m.PVCNamespace,
+			Name:      m.BackupName,
+			Labels:    map[string]string{backupManifestLabel: m.Version},
+		},
+		Data: map[string]string{backupManifestKey: string(raw)},
+	}
+	for k, v := range labels {
+		cm.Labels[k] = v
+	}
+	return cm, nil
+}
+
+// annotations returns the annotations describing the final Longhorn backup.
+func (m *backupManifest) annotations() map[string]string {
+	return map[string]string{
+		longhornBackupNameAnnotation:  m.BackupName,
+		longhornBackupURLAnnotation:   m.URL,
+		longhornBackupStateAnnotation: string(m.State),
+	}
+}
+
+// backupManifestFromConfigMap decodes the manifest stored in cm.
+func backupManifestFromConfigMap(cm *corev1api.ConfigMap) (*backupManifest, error) {
+	m := &backupManifest{}
+	if err := json.Unmarshal([]byte(cm.Data[backupManifestKey]), m); err != nil {
+		return nil, errors.Wrapf(err, "invalid Longhorn backup manifest %s/%s", cm.Namespace, cm.Name)
+	}
+	if m.Version != backupManifestVersion {
+		return nil, errors.Errorf("unsupported Longhorn backup manifest version %q in %s/%s", m.Version, cm.Namespace, cm.Name)
+	}
+	return m, nil
+}
+
+// createBackupManifest stores a new manifest in the cluster.
+func (c *longhornClient) createBackupManifest(m *backupManifest, labels map[string]string) error {
+	cm, err := m.configMap(labels)
+	if err != nil {
+		return err
+	}
+	return c.call("create backup manifest "+cm.Namespace+"/"+cm.Name, func(ctx context.Context) error {
+		_, err := c.k8s.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// completeBackupManifest records the final status of lhBackup in the manifest
+// stored in namespace. It is a no-op once the manifest holds a final state.
+func (c *longhornClient) completeBackupManifest(namespace string, lhBackup *longhorn.Backup) error {
+	return c.call("update backup manifest "+namespace+"/"+lhBackup.Name, func(ctx context.Context) error {
+		cm, err := c.k8s.CoreV1().ConfigMaps(namespace).Get(ctx, lhBackup.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		m, err := backupManifestFromConfigMap(cm)
+		if err != nil {
+			return err
+		}
+		if m.State == longhorn.BackupStateCompleted || m.State == longhorn.BackupStateError {
+			return nil
+		}
+
+		m.setBackupStatus(lhBackup)
+		raw, err := json.Marshal(m)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		cm.Data[backupManifestKey] = string(raw)
+		_, err = c.k8s.CoreV1().ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// getPVCBackupManifest returns the manifest of the PVC namespace/name in the
+// named Velero backup, or nil if the backup did not back up its data.
+func (c *longhornClient) getPVCBackupManifest(backupName, namespace, name string) (*backupManifest, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		backupManifestLabel: backupManifestVersion,
+		v1.BackupNameLabel:  label.GetValidName(backupName),
+	})
+	var list *corev1api.ConfigMapList
+	err := c.call("list backup manifests in "+namespace, func(ctx context.Context) error {
+		var err error
+		list, err = c.k8s.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		m, err := backupManifestFromConfigMap(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		if m.PVCName == name {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// deleteBackupManifest deletes the manifest of a cancelled or finalized
+// backup, treating an already deleted one as success.
+func (c *longhornClient) deleteBackupManifest(namespace, name string) error {
+	return c.call("delete backup manifest "+namespace+"/"+name, func(ctx context.Context) error {
+		err := c.k8s.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,162 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// testBackupManifest returns the pending manifest of the backup backupName
+// of the PVC app/data.
+func testBackupManifest(backupName string) *backupManifest {
+	return &backupManifest{
+		Version:      backupManifestVersion,
+		PVCNamespace: "app",
+		PVCName:      "data",
+		PVName:       "pvc-1",
+		VolumeName:   "pvc-1",
+		SnapshotName: "velero-snap-abc",
+		BackupName:   backupName,
+		State:        longhorn.BackupStatePending,
+	}
+}
+
+// testCompletedBackup returns the Longhorn backup of m once it completed.
+func testCompletedBackup(m *backupManifest) *longhorn.Backup {
+	return &longhorn.Backup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: m.BackupName},
+		Status: longhorn.BackupStatus{
+			State:            longhorn.BackupStateCompleted,
+			URL:              testBackupURL(testBackupTarget, m.BackupName, m.VolumeName),
+			Size:             "1073741824",
+			BackupTargetName: "default",
+		},
+	}
+}
+
+func TestBackupManifest(t *testing.T) {
+	client, _ := newFakeLonghornClient()
+	labels := map[string]string{v1.BackupNameLabel: "backup-1"}
+	m := testBackupManifest("velero-backup-abc")
+	require.NoError(t, client.createBackupManifest(m, labels))
+	// Creating it again, as a retried Execute would, is a no-op.
+	require.NoError(t, client.createBackupManifest(m, labels))
+	// Manifests of other PVCs and backups are not picked up.
+	other := testBackupManifest("velero-backup-def")
+	other.PVCName = "logs"
+	require.NoError(t, client.createBackupManifest(other, labels))
+	require.NoError(t, client.createBackupManifest(testBackupManifest("velero-backup-ghi"), map[string]string{v1.BackupNameLabel: "backup-0"}))
+
+	got, err := client.getPVCBackupManifest("backup-1", "app", "data")
+	require.NoError(t, err)
+	assert.Equal(t, m, got)
+
+	lhBackup := testCompletedBackup(m)
+	require.NoError(t, client.completeBackupManifest("app", lhBackup))
+	got, err = client.getPVCBackupManifest("backup-1", "app", "data")
+	require.NoError(t, err)
+	assert.Equal(t, longhorn.BackupStateCompleted, got.State)
+	assert.Equal(t, lhBackup.Status.URL, got.URL)
+	assert.Equal(t, "1073741824", got.Size)
+	assert.Equal(t, "default", got.BackupTargetName)
+
+	// A final state is never overwritten.
+	lhBackup.Status.State = longhorn.BackupStateError
+	require.NoError(t, client.completeBackupManifest("app", lhBackup))
+	got, err = client.getPVCBackupManifest("backup-1", "app", "data")
+	require.NoError(t, err)
+	assert.Equal(t, longhorn.BackupStateCompleted, got.State)
+
+	require.NoError(t, client.deleteBackupManifest("app", m.BackupName))
+	require.NoError(t, client.deleteBackupManifest("app", m.BackupName))
+	got, err = client.getPVCBackupManifest("backup-1", "app", "data")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestBackupManifestFromConfigMap(t *testing.T) {
+	cm, err := testBackupManifest("velero-backup-abc").configMap(nil)
+	require.NoError(t, err)
+	m, err := backupManifestFromConfigMap(cm)
+	require.NoError(t, err)
+	assert.Equal(t, testBackupManifest("velero-backup-abc"), m)
+
+	cm.Data[backupManifestKey] = `{"version":"v0"}`
+	_, err = backupManifestFromConfigMap(cm)
+	assert.Error(t, err)
+
+	_, err = backupManifestFromConfigMap(&corev1api.ConfigMap{Data: map[string]string{backupManifestKey: "{"}})
+	assert.Error(t, err)
+}
+
+func TestAnnotateLonghornBackup(t *testing.T) {
+	finalizing := &v1.Backup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "backup-1"},
+		Status:     v1.BackupStatus{Phase: v1.BackupPhaseFinalizing},
+	}
+
+	t.Run("annotates the PVC with a completed backup", func(t *testing.T) {
+		p := newTestBackupPlugin(t)
+		m := testBackupManifest("velero-backup-abc")
+		m.setBackupStatus(testCompletedBackup(m))
+		require.NoError(t, p.client.createBackupManifest(m, map[string]string{v1.BackupNameLabel: "backup-1"}))
+
+		item, err := p.annotateLonghornBackup(testBoundPVCItem(t), finalizing)
+		require.NoError(t, err)
+		annotations := item.(metav1.Object).GetAnnotations()
+		assert.Equal(t, "velero-backup-abc", annotations[longhornBackupNameAnnotation])
+		assert.Equal(t, m.URL, annotations[longhornBackupURLAnnotation])
+		assert.Equal(t, string(longhorn.BackupStateCompleted), annotations[longhornBackupStateAnnotation])
+
+		got, err := p.client.getPVCBackupManifest("backup-1", "app", "data")
+		require.NoError(t, err)
+		assert.Nil(t, got, "the manifest is deleted from the cluster")
+	})
+
+	t.Run("leaves the PVC of a failed backup alone", func(t *testing.T) {
+		p := newTestBackupPlugin(t)
+		m := testBackupManifest("velero-backup-abc")
+		m.State = longhorn.BackupStateError
+		require.NoError(t, p.client.createBackupManifest(m, map[string]string{v1.BackupNameLabel: "backup-1"}))
+
+		item, err := p.annotateLonghornBackup(testBoundPVCItem(t), finalizing)
+		require.NoError(t, err)
+		assert.Empty(t, item.(metav1.Object).GetAnnotations())
+
+		got, err := p.client.getPVCBackupManifest("backup-1", "app", "data")
+		require.NoError(t, err)
+		assert.Nil(t, got)
+	})
+
+	t.Run("leaves a PVC without a manifest alone", func(t *testing.T) {
+		p := newTestBackupPlugin(t)
+
+		item, err := p.annotateLonghornBackup(testBoundPVCItem(t), finalizing)
+		require.NoError(t, err)
+		assert.Empty(t, item.(metav1.Object).GetAnnotations())
+	})
+}
@@ -0,0 +1,156 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// volumeMappingsConfigKey holds the YAML list of volumeMappings applied to
+// the Longhorn PVs, PVCs and volumes of a restore, for example:
+//
+//	volumeMappings: |
+//	  - match:
+//	      storageClass: longhorn-fast
+//	      namespace: prod
+//	    storageClass: longhorn-dr
+//	    numberOfReplicas: 2
+//	    diskSelector: [ssd]
+const volumeMappingsConfigKey = "volumeMappings"
+
+// sourceStorageClassAnnotation on a restored PV whose storage class a volume
+// mapping changed records the storage class it was backed up with, so its
+// Longhorn volume, restored later, still matches the same mapping.
+const sourceStorageClassAnnotation = "velero.io/longhorn-source-storage-class"
+
+// volumeMappingMatch selects the volumes a volumeMapping applies to. Every
+// criterion set must match; an empty match selects every volume. The
+// namespace is the namespace the PVC was backed up from.
+type volumeMappingMatch struct {
+	StorageClass  string `json:"storageClass,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	LabelSelector string `json:"labelSelector,omitempty"`
+}
+
+// volumeMapping rewrites the storage class and Longhorn parameters of the
+// restored volumes it matches. Unset fields are left alone.
+type volumeMapping struct {
+	Match volumeMappingMatch `json:"match"`
+
+	StorageClass       string                      `json:"storageClass,omitempty"`
+	NumberOfReplicas   int                         `json:"numberOfReplicas,omitempty"`
+	DataLocality       longhorn.DataLocality       `json:"dataLocality,omitempty"`
+	DiskSelector       []string                    `json:"diskSelector,omitempty"`
+	NodeSelector       []string                    `json:"nodeSelector,omitempty"`
+	ReplicaAutoBalance longhorn.ReplicaAutoBalance `json:"replicaAutoBalance,omitempty"`
+
+	selector labels.Selector
+}
+
+// parseVolumeMappings reads the volume mappings from the plugin config.
+func parseVolumeMappings(config map[string]string) ([]*volumeMapping, error) {
+	raw := config[volumeMappingsConfigKey]
+	if raw == "" {
+		return nil, nil
+	}
+	var mappings []*volumeMapping
+	if err := yaml.UnmarshalStrict([]byte(raw), &mappings); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", volumeMappingsConfigKey)
+	}
+	for i, m := range mappings {
+		selector, err := labels.Parse(m.Match.LabelSelector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid label selector in %s entry %d", volumeMappingsConfigKey, i)
+		}
+		m.selector = selector
+	}
+	return mappings, nil
+}
+
+// findVolumeMapping returns the first mapping matching a volume of the given
+// storage class, source namespace and labels, or nil if none does.
+func findVolumeMapping(mappings []*volumeMapping, storageClass, namespace string, objLabels map[string]string) *volumeMapping {
+	for _, m := range mappings {
+		if m.Match.StorageClass != "" && m.Match.StorageClass != storageClass {
+			continue
+		}
+		if m.Match.Namespace != "" && m.Match.Namespace != namespace {
+			continue
+		}
+		if !m.selector.Matches(labels.Set(objLabels)) {
+			continue
+		}
+		return m
+	}
+	return nil
+}
+
+// applyToSpec sets the Longhorn parameters of the mapping on spec.
+func (m *volumeMapping) applyToSpec(spec *longhorn.VolumeSpec) {
+	if m.NumberOfReplicas > 0 {
+		spec.NumberOfReplicas = m.NumberOfReplicas
+	}
+	if m.DataLocality != "" {
+		spec.DataLocality = m.DataLocality
+	}
+	if m.DiskSelector != nil {
+		spec.DiskSelector = m.DiskSelector
+	}
+	if m.NodeSelector != nil {
+		spec.NodeSelector = m.NodeSelector
+	}
+	if m.ReplicaAutoBalance != "" {
+		spec.ReplicaAutoBalance = m.ReplicaAutoBalance
+	}
+}
+
+// applyToUnstructured sets the Longhorn parameters of the mapping on a Volume
+// CR edited as unstructured content, like applyToSpec.
+func (m *volumeMapping) applyToUnstructured(obj *unstructured.Unstructured) error {
+	if m.NumberOfReplicas > 0 {
+		if err := unstructured.SetNestedField(obj.Object, int64(m.NumberOfReplicas), "spec", "numberOfReplicas"); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if m.DataLocality != "" {
+		if err := unstructured.SetNestedField(obj.Object, string(m.DataLocality), "spec", "dataLocality"); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if m.DiskSelector != nil {
+		if err := unstructured.SetNestedStringSlice(obj.Object, m.DiskSelector, "spec", "diskSelector"); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if m.NodeSelector != nil {
+		if err := unstructured.SetNestedStringSlice(obj.Object, m.NodeSelector, "spec", "nodeSelector"); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if m.ReplicaAutoBalance != "" {
+		if err := unstructured.SetNestedField(obj.Object, string(m.ReplicaAutoBalance), "spec", "replicaAutoBalance"); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindVolumeMapping(t *testing.T) {
+	mappings, err := parseVolumeMappings(map[string]string{volumeMappingsConfigKey: `
+- match:
+    storageClass: longhorn-ssd
+    namespace: prod
+  numberOfReplicas: 3
+- match:
+    labelSelector: tier=cache
+  numberOfReplicas: 1
+- match:
+    namespace: prod
+  storageClass: longhorn-prod
+- match: {}
+  dataLocality: best-effort
+`})
+	require.NoError(t, err)
+	require.Len(t, mappings, 4)
+
+	tests := []struct {
+		name         string
+		storageClass string
+		namespace    string
+		labels       map[string]string
+		want         *volumeMapping
+	}{
+		{name: "all criteria match", storageClass: "longhorn-ssd", namespace: "prod", want: mappings[0]},
+		{name: "first match wins", storageClass: "longhorn-ssd", namespace: "prod", labels: map[string]string{"tier": "cache"}, want: mappings[0]},
+		{name: "label selector", storageClass: "longhorn", namespace: "prod", labels: map[string]string{"tier": "cache"}, want: mappings[1]},
+		{name: "namespace only", storageClass: "longhorn", namespace: "prod", want: mappings[2]},
+		{name: "empty match", storageClass: "longhorn-ssd", namespace: "dev", want: mappings[3]},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Same(t, tc.want, findVolumeMapping(mappings, tc.storageClass, tc.namespace, tc.labels))
+		})
+	}
+
+	assert.Nil(t, findVolumeMapping(mappings[:3], "longhorn", "dev", nil))
+	assert.Nil(t, findVolumeMapping(nil, "longhorn", "prod", nil))
+}
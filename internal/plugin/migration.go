@@ -0,0 +1,84 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// migrationWaitTimeoutConfigKey bounds how long CreateSnapshot waits for
+	// a live migration of the volume to finish.
+	migrationWaitTimeoutConfigKey = "migrationWaitTimeout"
+
+	defaultMigrationWaitTimeout = 10 * time.Minute
+)
+
+// isMigrating reports whether a live migration of vol is requested or still
+// running. While it is, the volume has an engine on both nodes.
+func isMigrating(vol *longhorn.Volume) bool {
+	return vol.Spec.MigrationNodeID != "" || vol.Status.CurrentMigrationNodeID != ""
+}
+
+// hasSettledEngine reports whether the engine of vol runs on the node that
+// owns the volume, which is where Longhorn takes the snapshot.
+func hasSettledEngine(vol *longhorn.Volume) bool {
+	return vol.Spec.NodeID == "" || vol.Status.CurrentNodeID == vol.Spec.NodeID
+}
+
+// waitForMigration waits until a live migration of the volume has completed
+// or rolled back and its engine settled on the owning node, so the snapshot
+// is not taken while the engine switches.
+func (p *VolumeSnapshotter) waitForMigration(volumeID string) error {
+	vol, err := p.cache.volumes.Get(volumeID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get volume %s", volumeID)
+	}
+	if !isMigrating(vol) {
+		return nil
+	}
+
+	log := p.WithField("volume", volumeID)
+	log.Infof("Volume is migrating from node %v to node %v, waiting up to %v for the migration to finish",
+		vol.Spec.NodeID, vol.Spec.MigrationNodeID, p.migrationWaitTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.migrationWaitTimeout)
+	defer cancel()
+	err = waitForObject(ctx, p.cache.volumeInformer, volumeID, func() (bool, error) {
+		vol, err = p.cache.volumes.Get(volumeID)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, errors.Errorf("volume %s was deleted", volumeID)
+			}
+			return false, err
+		}
+		return !isMigrating(vol) && hasSettledEngine(vol), nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "live migration of volume %s did not finish", volumeID)
+	}
+
+	log.Infof("Volume migration finished, snapshotting on node %v", vol.Status.CurrentNodeID)
+	return nil
+}
@@ -0,0 +1,322 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	riav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/restoreitemaction/v2"
+)
+
+// restoreSchedulingGate keeps a restored pod off the nodes until Longhorn has
+// restored the data of the volumes it mounts.
+const restoreSchedulingGate = "velero.io/longhorn-restore"
+
+// PodRestorePlugin is a v2 restore item action plugin for Velero. It holds
+// back restored pods mounting Longhorn PVCs whose data is still being
+// restored.
+type PodRestorePlugin struct {
+	log    logrus.FieldLogger
+	client *longhornClient
+	cache  *longhornCache
+}
+
+// NewPodRestorePlugin instantiates a PodRestorePlugin.
+func NewPodRestorePlugin(log logrus.FieldLogger) *PodRestorePlugin {
+	return &PodRestorePlugin{log: log}
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *PodRestorePlugin) Name() string {
+	return "longhornPodRestorePlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *PodRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{kuberesource.Pods.String()},
+	}, nil
+}
+
+// init creates the API client and the shared cache on first use, since
+// restore item actions have no Init hook.
+func (p *PodRestorePlugin) init() error {
+	if p.client == nil {
+		client, err := newLonghornClient(p.log, nil)
+		if err != nil {
+			return err
+		}
+		config, err := client.getPluginConfig(common.PluginKindRestoreItemActionV2, PodRestorePluginName)
+		if err != nil {
+			return err
+		}
+		if err := client.configure(config); err != nil {
+			return err
+		}
+		p.client = client
+	}
+	if p.cache == nil {
+		lhCache, err := getLonghornCache(p.client)
+		if err != nil {
+			return err
+		}
+		p.cache = lhCache
+	}
+	return nil
+}
+
+// podRestoreOperation identifies a restored pod gated until the restore of
+// its Longhorn volumes completes.
+type podRestoreOperation struct {
+	namespace string
+	name      string
+	volumes   []string
+}
+
+// String encodes the operation as the operation ID handed to Velero.
+func (o podRestoreOperation) String() string {
+	return strings.Join([]string{o.namespace, o.name, strings.Join(o.volumes, ",")}, "/")
+}
+
+// parsePodRestoreOperation decodes an operation ID built by podRestoreOperation.String.
+func parsePodRestoreOperation(operationID string) (podRestoreOperation, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 3 {
+		return podRestoreOperation{}, riav2.InvalidOperationIDError(operationID)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return podRestoreOperation{}, riav2.InvalidOperationIDError(operationID)
+		}
+	}
+	return podRestoreOperation{namespace: parts[0], name: parts[1], volumes: strings.Split(parts[2], ",")}, nil
+}
+
+// Execute adds restoreSchedulingGate to a pod that mounts PVCs whose Longhorn
+// volumes this restore is still restoring, and returns an operation that
+// removes the gate once all of them are restored. Other pods are restored
+// unchanged.
+func (p *PodRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	pod := new(corev1api.Pod)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pod); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !mountsPVC(pod) {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+
+	op := podRestoreOperation{namespace: pod.Namespace, name: pod.Name}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		volumeName, err := p.restoringVolume(pod.Namespace, volume.PersistentVolumeClaim.ClaimName, input.Restore)
+		if err != nil {
+			return nil, err
+		}
+		if volumeName != "" {
+			op.volumes = append(op.volumes, volumeName)
+		}
+	}
+	if len(op.volumes) == 0 {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	p.log.Infof("Gating pod %s/%s until Longhorn volumes %v are restored", pod.Namespace, pod.Name, op.volumes)
+	pod.Spec.SchedulingGates = append(pod.Spec.SchedulingGates, corev1api.PodSchedulingGate{Name: restoreSchedulingGate})
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	input.Item.SetUnstructuredContent(item)
+	return velero.NewRestoreItemActionExecuteOutput(input.Item).WithOperationID(op.String()), nil
+}
+
+// mountsPVC reports whether pod mounts any PVC.
+func mountsPVC(pod *corev1api.Pod) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// restoringVolume returns the name of the Longhorn volume behind the PVC
+// namespace/claimName if restore created it, from a Longhorn backup or a
+// Velero native snapshot, and has not finished restoring its data, and an
+// empty string otherwise. PVCs are restored before pods, so the PVC is
+// already bound.
+func (p *PodRestorePlugin) restoringVolume(namespace, claimName string, restore *v1.Restore) (string, error) {
+	var pvc *corev1api.PersistentVolumeClaim
+	err := p.client.call("get PVC "+namespace+"/"+claimName, func(ctx context.Context) error {
+		var err error
+		pvc, err = p.client.k8s.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claimName, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if pvc.Spec.VolumeName == "" {
+		return "", nil
+	}
+
+	// The PV restored from a snapshot is usually renamed, and named after
+	// neither the backed up PV nor its Longhorn volume, so the volume is
+	// found through the PV.
+	pv, err := p.client.findRestoredPersistentVolume(pvc.Spec.VolumeName, restore)
+	if err != nil || pv == nil {
+		return "", err
+	}
+	volumeName := longhornVolumeName(pv)
+	if volumeName == "" {
+		return "", nil
+	}
+	vol, err := p.client.getVolume(p.cache, volumeName)
+	if err != nil || vol == nil {
+		return "", err
+	}
+	if _, ok := vol.Labels[sourceVolumeLabel]; !ok || !restoredBy(vol, restore) {
+		return "", nil
+	}
+	status, err := p.cache.volumeRestoreStatus(vol)
+	if err != nil || status.done {
+		return "", err
+	}
+	return vol.Name, nil
+}
+
+// Progress reports how many of the Longhorn volumes of a gated pod are
+// restored, and removes the gate once all of them are.
+func (p *PodRestorePlugin) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+	op, err := parsePodRestoreOperation(operationID)
+	if err != nil {
+		return progress, err
+	}
+	if err := p.init(); err != nil {
+		return progress, err
+	}
+
+	progress.Started = restore.CreationTimestamp.Time
+	if restore.Status.StartTimestamp != nil {
+		progress.Started = restore.Status.StartTimestamp.Time
+	}
+	progress.Updated = time.Now()
+	progress.OperationUnits = "volumes"
+	progress.NTotal = int64(len(op.volumes))
+	for _, volumeName := range op.volumes {
+		vol, err := p.client.getVolume(p.cache, volumeName)
+		if err != nil {
+			return progress, err
+		}
+		if vol == nil {
+			// Not restored yet; Cancel releases the pod if it never is.
+			continue
+		}
+		status, err := p.cache.volumeRestoreStatus(vol)
+		if err != nil {
+			return progress, err
+		}
+		if status.failure != "" {
+			// The gate stays so the pod does not run on incomplete data.
+			progress.Completed = true
+			progress.Err = fmt.Sprintf("Longhorn restore of volume %s for pod %s/%s failed: %s", volumeName, op.namespace, op.name, status.failure)
+			return progress, nil
+		}
+		if status.done {
+			progress.NCompleted++
+		}
+	}
+	if progress.NCompleted < progress.NTotal {
+		return progress, nil
+	}
+
+	if err := p.removeSchedulingGate(op.namespace, op.name); err != nil {
+		return progress, err
+	}
+	progress.Completed = true
+	return progress, nil
+}
+
+// removeSchedulingGate removes restoreSchedulingGate from the pod, treating
+// a deleted pod or a removed gate as success.
+func (p *PodRestorePlugin) removeSchedulingGate(namespace, name string) error {
+	return p.client.call("remove scheduling gate of pod "+namespace+"/"+name, func(ctx context.Context) error {
+		pod, err := p.client.k8s.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		gates := pod.Spec.SchedulingGates[:0]
+		for _, gate := range pod.Spec.SchedulingGates {
+			if gate.Name != restoreSchedulingGate {
+				gates = append(gates, gate)
+			}
+		}
+		if len(gates) == len(pod.Spec.SchedulingGates) {
+			return nil
+		}
+		pod.Spec.SchedulingGates = gates
+		_, err = p.client.k8s.CoreV1().Pods(namespace).Update(ctx, pod, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Cancel removes the scheduling gate of the pod, since Velero stops waiting
+// for its volumes.
+func (p *PodRestorePlugin) Cancel(operationID string, restore *v1.Restore) error {
+	op, err := parsePodRestoreOperation(operationID)
+	if err != nil {
+		return err
+	}
+	if err := p.init(); err != nil {
+		return err
+	}
+	p.log.Infof("Releasing pod %s/%s, its Longhorn volumes may not be fully restored", op.namespace, op.name)
+	return p.removeSchedulingGate(op.namespace, op.name)
+}
+
+// AreAdditionalItemsReady always reports true, since the action returns no additional items.
+func (p *PodRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	return true, nil
+}
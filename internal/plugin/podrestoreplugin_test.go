@@ -0,0 +1,142 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// testPod returns a pod app/web mounting the PVC app/data.
+func testPod() *corev1api.Pod {
+	return &corev1api.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "web"},
+		Spec: corev1api.PodSpec{
+			Containers: []corev1api.Container{{Name: "web", Image: "nginx"}},
+			Volumes: []corev1api.Volume{{
+				Name: "data",
+				VolumeSource: corev1api.VolumeSource{
+					PersistentVolumeClaim: &corev1api.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+				},
+			}},
+		},
+	}
+}
+
+// testBoundPVC returns the PVC app/data bound to the PV pvName.
+func testBoundPVC(pvName string) *corev1api.PersistentVolumeClaim {
+	return &corev1api.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "data"},
+		Spec:       corev1api.PersistentVolumeClaimSpec{VolumeName: pvName},
+		Status:     corev1api.PersistentVolumeClaimStatus{Phase: corev1api.ClaimBound},
+	}
+}
+
+func TestPodRestoreGatesSnapshotClones(t *testing.T) {
+	restore := testRestore()
+	renamedPV, clone := testSnapshotRestoredPV("pvc-1", restore)
+	clone.Status.CloneStatus.State = longhorn.VolumeCloneStateInitiated
+	client, lh := newFakeLonghornClient(testBoundPVC(renamedPV.Name), renamedPV, clone)
+	p := &PodRestorePlugin{log: client.log, client: client, cache: newFakeLonghornCache(t, client)}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(testPod())
+	require.NoError(t, err)
+	output, err := p.Execute(&velero.RestoreItemActionExecuteInput{
+		Item:           &unstructured.Unstructured{Object: content},
+		ItemFromBackup: &unstructured.Unstructured{Object: content},
+		Restore:        restore,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "app/web/"+clone.Name, output.OperationID)
+
+	gated := new(corev1api.Pod)
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), gated))
+	assert.Equal(t, []corev1api.PodSchedulingGate{{Name: restoreSchedulingGate}}, gated.Spec.SchedulingGates)
+	_, err = client.k8s.CoreV1().Pods("app").Create(context.Background(), gated, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	progress, err := p.Progress(output.OperationID, restore)
+	require.NoError(t, err)
+	assert.False(t, progress.Completed)
+
+	clone.Status.CloneStatus.State = longhorn.VolumeCloneStateCompleted
+	_, err = lh.LonghornV1beta2().Volumes(longhornNamespace).UpdateStatus(context.Background(), clone, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		progress, err = p.Progress(output.OperationID, restore)
+		require.NoError(t, err)
+		return progress.Completed
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, progress.Err)
+
+	pod, err := client.k8s.CoreV1().Pods("app").Get(context.Background(), "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, pod.Spec.SchedulingGates)
+}
+
+func TestPodRestoreSkipsVolumesOfOtherRestores(t *testing.T) {
+	restore := testRestore()
+	tests := []struct {
+		name   string
+		modify func(pv *corev1api.PersistentVolume, vol *longhorn.Volume)
+	}{
+		{
+			name:   "PV of another restore",
+			modify: func(pv *corev1api.PersistentVolume, _ *longhorn.Volume) { pv.Labels[v1.RestoreNameLabel] = "restore-0" },
+		},
+		{
+			name: "volume created before the restore",
+			modify: func(_ *corev1api.PersistentVolume, vol *longhorn.Volume) {
+				vol.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+			},
+		},
+		{
+			name: "volume of another restore",
+			modify: func(_ *corev1api.PersistentVolume, vol *longhorn.Volume) {
+				vol.Labels[v1.RestoreUIDLabel] = "restore-uid-0"
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			renamedPV, clone := testSnapshotRestoredPV("pvc-1", restore)
+			clone.Status.CloneStatus.State = longhorn.VolumeCloneStateInitiated
+			tc.modify(renamedPV, clone)
+			client, _ := newFakeLonghornClient(testBoundPVC(renamedPV.Name), renamedPV, clone)
+			p := &PodRestorePlugin{log: client.log, client: client, cache: newFakeLonghornCache(t, client)}
+
+			volumeName, err := p.restoringVolume("app", "data", restore)
+			require.NoError(t, err)
+			assert.Empty(t, volumeName)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// recurringJobLabelPrefix and recurringJobGroupLabelPrefix prefix the
+	// labels that assign a recurring job, or every job of a group, to a
+	// Longhorn volume or its PVC.
+	recurringJobLabelPrefix      = "recurring-job.longhorn.io/"
+	recurringJobGroupLabelPrefix = "recurring-job-group.longhorn.io/"
+	recurringJobLabelEnabled     = "enabled"
+
+	// recurringJobDefaultGroup is the group Longhorn applies to volumes that
+	// have no recurring job labels at all.
+	recurringJobDefaultGroup = "default"
+)
+
+// recurringJobSelection returns the recurring jobs and job groups assigned by
+// labelSets.
+func recurringJobSelection(labelSets ...map[string]string) (jobs, groups map[string]bool) {
+	jobs, groups = map[string]bool{}, map[string]bool{}
+	for _, set := range labelSets {
+		for k, v := range set {
+			if v != recurringJobLabelEnabled {
+				continue
+			}
+			if name, ok := strings.CutPrefix(k, recurringJobLabelPrefix); ok {
+				jobs[name] = true
+			}
+			if group, ok := strings.CutPrefix(k, recurringJobGroupLabelPrefix); ok {
+				groups[group] = true
+			}
+		}
+	}
+	if len(jobs) == 0 && len(groups) == 0 {
+		groups[recurringJobDefaultGroup] = true
+	}
+	return jobs, groups
+}
+
+// referencedRecurringJobs returns the RecurringJob CRs assigned to a volume
+// by its labels and those of its PVC. Jobs referenced by a label but missing
+// in the cluster are left out.
+func (c *longhornCache) referencedRecurringJobs(labelSets ...map[string]string) ([]*longhorn.RecurringJob, error) {
+	jobs, groups := recurringJobSelection(labelSets...)
+
+	all, err := c.recurringJobs.List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list recurring jobs")
+	}
+	var referenced []*longhorn.RecurringJob
+	for _, job := range all {
+		if jobs[job.Name] {
+			referenced = append(referenced, job)
+			continue
+		}
+		for _, group := range job.Spec.Groups {
+			if groups[group] {
+				referenced = append(referenced, job)
+				break
+			}
+		}
+	}
+	return referenced, nil
+}
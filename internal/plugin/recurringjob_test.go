@@ -0,0 +1,80 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecurringJobSelection(t *testing.T) {
+	tests := []struct {
+		name       string
+		labelSets  []map[string]string
+		wantJobs   map[string]bool
+		wantGroups map[string]bool
+	}{
+		{
+			name:       "no labels selects the default group",
+			labelSets:  []map[string]string{nil, {"app": "db"}},
+			wantJobs:   map[string]bool{},
+			wantGroups: map[string]bool{recurringJobDefaultGroup: true},
+		},
+		{
+			name: "jobs and groups from every set",
+			labelSets: []map[string]string{
+				{recurringJobLabelPrefix + "daily": recurringJobLabelEnabled},
+				{recurringJobGroupLabelPrefix + "gold": recurringJobLabelEnabled},
+			},
+			wantJobs:   map[string]bool{"daily": true},
+			wantGroups: map[string]bool{"gold": true},
+		},
+		{
+			name: "disabled labels are ignored",
+			labelSets: []map[string]string{{
+				recurringJobLabelPrefix + "daily":     "disabled",
+				recurringJobGroupLabelPrefix + "gold": recurringJobLabelEnabled,
+			}},
+			wantJobs:   map[string]bool{},
+			wantGroups: map[string]bool{"gold": true},
+		},
+		{
+			name: "only disabled labels select the default group",
+			labelSets: []map[string]string{{
+				recurringJobLabelPrefix + "daily": "disabled",
+			}},
+			wantJobs:   map[string]bool{},
+			wantGroups: map[string]bool{recurringJobDefaultGroup: true},
+		},
+		{
+			name: "an explicit job drops the default group",
+			labelSets: []map[string]string{{
+				recurringJobLabelPrefix + "weekly": recurringJobLabelEnabled,
+			}},
+			wantJobs:   map[string]bool{"weekly": true},
+			wantGroups: map[string]bool{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			jobs, groups := recurringJobSelection(tc.labelSets...)
+			assert.Equal(t, tc.wantJobs, jobs)
+			assert.Equal(t, tc.wantGroups, groups)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	riav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/restoreitemaction/v2"
+)
+
+// ResourceRestorePlugin is a v2 restore item action plugin for Velero. It
+// keeps Longhorn CRs that only describe the source cluster, and the Longhorn
+// backup manifests, out of the restore and adapts the others to the target
+// cluster.
+type ResourceRestorePlugin struct {
+	log    logrus.FieldLogger
+	client *longhornClient
+	cache  *longhornCache
+	config map[string]string
+
+	// volumeMappings are the ones configured for RestorePluginV2, applied
+	// to restored Volume CRs too.
+	volumeMappings     []*volumeMapping
+	settingDefinitions map[string]settingDefinition
+}
+
+// NewResourceRestorePlugin instantiates a ResourceRestorePlugin.
+func NewResourceRestorePlugin(log logrus.FieldLogger) *ResourceRestorePlugin {
+	return &ResourceRestorePlugin{log: log}
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *ResourceRestorePlugin) Name() string {
+	return "longhornResourceRestorePlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *ResourceRestorePlugin) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: append([]string{configMaps.String(), longhornVolumes.String(), longhornSettings.String()}, longhornRuntimeResources...),
+	}, nil
+}
+
+// init creates the API client and the shared cache on first use, since
+// restore item actions have no Init hook.
+func (p *ResourceRestorePlugin) init() error {
+	if p.client == nil {
+		client, err := newLonghornClient(p.log, nil)
+		if err != nil {
+			return err
+		}
+		p.client = client
+	}
+	if p.cache == nil {
+		lhCache, err := getLonghornCache(p.client)
+		if err != nil {
+			return err
+		}
+		p.cache = lhCache
+	}
+	if p.config == nil {
+		config, err := p.client.getPluginConfig(common.PluginKindRestoreItemActionV2, ResourceRestorePluginName)
+		if err != nil {
+			return err
+		}
+		if err := p.client.configure(config); err != nil {
+			return err
+		}
+		restoreConfig, err := p.client.getPluginConfig(common.PluginKindRestoreItemActionV2, RestorePluginV2Name)
+		if err != nil {
+			return err
+		}
+		if p.volumeMappings, err = parseVolumeMappings(restoreConfig); err != nil {
+			return err
+		}
+		p.config = config
+	}
+	return nil
+}
+
+// Execute skips the restore of Longhorn runtime CRs, whether or not the backup
+// action reduced them to a stub, since Longhorn recreates them from the config
+// kinds, and of the Longhorn backup manifests, whose content the restored PVCs
+// carry. Volumes are rewritten for the target cluster, and settings are
+// merged into the ones Longhorn already created there.
+func (p *ResourceRestorePlugin) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	metadata, err := meta.Accessor(input.Item)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	kind := input.Item.GetObjectKind().GroupVersionKind().Kind
+	if kind == "ConfigMap" {
+		if _, ok := metadata.GetLabels()[backupManifestLabel]; ok {
+			p.log.Infof("Skipping Longhorn backup manifest %s/%s", metadata.GetNamespace(), metadata.GetName())
+			return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+		}
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if longhornRuntimeKinds[kind] {
+		p.log.Infof("Skipping Longhorn runtime object %s %s", kind, metadata.GetName())
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "Volume":
+		return p.restoreVolume(input)
+	case "Setting":
+		return p.restoreSetting(input)
+	default:
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+}
+
+// Progress is not supported, since the action starts no operations.
+func (p *ResourceRestorePlugin) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	return velero.OperationProgress{}, riav2.InvalidOperationIDError(operationID)
+}
+
+// Cancel is a no-op, since the action starts no operations.
+func (p *ResourceRestorePlugin) Cancel(operationID string, restore *v1.Restore) error {
+	return nil
+}
+
+// AreAdditionalItemsReady always reports true, since the action returns no additional items.
+func (p *ResourceRestorePlugin) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// longhornDriverName is the name of the Longhorn CSI driver.
+const longhornDriverName = "driver.longhorn.io"
+
+// Group resources of the objects the plugins back up or restore.
+var (
+	configMaps = schema.GroupResource{Group: "", Resource: "configmaps"}
+
+	longhornVolumes       = schema.GroupResource{Group: "longhorn.io", Resource: "volumes"}
+	longhornBackingImages = schema.GroupResource{Group: "longhorn.io", Resource: "backingimages"}
+	longhornRecurringJobs = schema.GroupResource{Group: "longhorn.io", Resource: "recurringjobs"}
+	longhornSettings      = schema.GroupResource{Group: "longhorn.io", Resource: "settings"}
+	longhornBackupTargets = schema.GroupResource{Group: "longhorn.io", Resource: "backuptargets"}
+)
+
+// longhornRuntimeResources are the resources of longhornRuntimeKinds. Velero
+// selectors take no group wildcards, so they are listed one by one.
+var longhornRuntimeResources = []string{
+	"engines.longhorn.io",
+	"replicas.longhorn.io",
+	"instancemanagers.longhorn.io",
+	"engineimages.longhorn.io",
+	"nodes.longhorn.io",
+	"volumeattachments.longhorn.io",
+	"sharemanagers.longhorn.io",
+	"snapshots.longhorn.io",
+	"backups.longhorn.io",
+	"backupvolumes.longhorn.io",
+	"backupbackingimages.longhorn.io",
+	"backingimagemanagers.longhorn.io",
+	"backingimagedatasources.longhorn.io",
+	"orphans.longhorn.io",
+	"supportbundles.longhorn.io",
+	"systembackups.longhorn.io",
+	"systemrestores.longhorn.io",
+}
+
+// longhornResources returns every Longhorn resource the plugins handle.
+func longhornResources() []string {
+	resources := []string{
+		longhornVolumes.String(),
+		longhornBackingImages.String(),
+		longhornRecurringJobs.String(),
+		longhornSettings.String(),
+		longhornBackupTargets.String(),
+	}
+	return append(resources, longhornRuntimeResources...)
+}
+
+// longhornVolumeName returns the name of the Longhorn volume backing pv, or
+// an empty string if pv is not provisioned by the Longhorn CSI driver.
+func longhornVolumeName(pv *corev1api.PersistentVolume) string {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != longhornDriverName {
+		return ""
+	}
+	return pv.Spec.CSI.VolumeHandle
+}
@@ -0,0 +1,338 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	riav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/restoreitemaction/v2"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// engineVolumeLabel is the label Longhorn ties an Engine CR to its volume with.
+	engineVolumeLabel = "longhornvolume"
+	// sourceVolumeLabel names the backed up volume a restored volume recreates.
+	sourceVolumeLabel = "velero.io/longhorn-source-volume"
+	// originalPVNameAnnotation is set by Velero on a PV it restored under a
+	// new name, like the one SetVolumeID gives a PV restored from a snapshot.
+	originalPVNameAnnotation = "velero.io/original-pv-name"
+
+	// preserveVolumeNamesConfigKey restores volumes under their original
+	// name when no volume or PV in the cluster uses it yet.
+	preserveVolumeNamesConfigKey = "preserveVolumeNames"
+)
+
+// restoredVolumeName returns the name of the Longhorn volume, and PV, that
+// restore recreates the PV pvName as. It is the same on every call, so a
+// retried restore item action finds the volume it already created, and
+// differs between restores, so one backup can be restored several times.
+func restoredVolumeName(restoreUID types.UID, pvName string) string {
+	sum := sha256.Sum256([]byte(string(restoreUID) + "/" + pvName))
+	return "velero-" + hex.EncodeToString(sum[:])[:16]
+}
+
+// volumeNameAvailable reports whether a restored volume may take name: no
+// Longhorn volume or PV uses it, or only ones that the restore with the given
+// UID created on an earlier attempt.
+func (c *longhornClient) volumeNameAvailable(name string, restoreUID types.UID) (bool, error) {
+	ownedByRestore := func(objLabels map[string]string) bool {
+		return restoreUID != "" && objLabels[v1.RestoreUIDLabel] == string(restoreUID)
+	}
+
+	var vol *longhorn.Volume
+	err := c.call("get volume "+name, func(ctx context.Context) error {
+		var err error
+		vol, err = c.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	switch {
+	case err == nil && !ownedByRestore(vol.Labels):
+		return false, nil
+	case err != nil && !apierrors.IsNotFound(err):
+		return false, err
+	}
+
+	var pv *corev1api.PersistentVolume
+	err = c.call("get persistent volume "+name, func(ctx context.Context) error {
+		var err error
+		pv, err = c.k8s.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	switch {
+	case err == nil:
+		return ownedByRestore(pv.Labels), nil
+	case apierrors.IsNotFound(err):
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// backupURLVolumeName returns the name of the volume a Longhorn backup URL
+// belongs to, or an empty string if the URL does not say.
+func backupURLVolumeName(backupURL string) string {
+	u, err := url.Parse(backupURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("volume")
+}
+
+// isRecreatedVolume reports whether restore already recreated the backed up
+// volume volumeName under another name, from a Velero snapshot or a Longhorn
+// backup. Longhorn CRs are restored after PVs and PVCs, so by the time the
+// Volume CR comes up its data has been restored.
+func (c *longhornCache) isRecreatedVolume(volumeName string, restore *v1.Restore) (bool, error) {
+	volumes, err := c.volumes.List(labels.SelectorFromSet(labels.Set{sourceVolumeLabel: volumeName}))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to list volumes restored from %s", volumeName)
+	}
+	for _, vol := range volumes {
+		if restoredBy(vol, restore) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// restoredBy reports whether restore created the restored volume vol.
+// Volumes restored from a Longhorn backup name their restore. Those the
+// volume snapshotter creates do not, so only their age tells.
+func restoredBy(vol *longhorn.Volume, restore *v1.Restore) bool {
+	if restoreUID, ok := vol.Labels[v1.RestoreUIDLabel]; ok {
+		return restoreUID == string(restore.UID)
+	}
+	return restore.Status.StartTimestamp == nil || !vol.CreationTimestamp.Before(restore.Status.StartTimestamp)
+}
+
+// findRestoredPersistentVolume returns the PV restore created for the backed
+// up PV pvName, or nil if it created none. Velero renames the PVs it restores
+// from snapshots, and only remaps the PVC items after the restore item
+// actions ran, so the PV is matched on its original name first.
+func (c *longhornClient) findRestoredPersistentVolume(pvName string, restore *v1.Restore) (*corev1api.PersistentVolume, error) {
+	selector := labels.SelectorFromSet(labels.Set{v1.RestoreNameLabel: label.GetValidName(restore.Name)})
+	var list *corev1api.PersistentVolumeList
+	err := c.call("list persistent volumes of restore "+restore.Name, func(ctx context.Context) error {
+		var err error
+		list, err = c.k8s.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var found *corev1api.PersistentVolume
+	for i := range list.Items {
+		pv := &list.Items[i]
+		if pv.Annotations[originalPVNameAnnotation] == pvName {
+			return pv, nil
+		}
+		if pv.Name == pvName {
+			found = pv
+		}
+	}
+	return found, nil
+}
+
+// getVolume returns the named volume from cache or, if its informer has not
+// seen the volume yet, from the API server. It returns nil if there is no
+// such volume.
+func (c *longhornClient) getVolume(cache *longhornCache, name string) (*longhorn.Volume, error) {
+	vol, err := cache.volumes.Get(name)
+	if err == nil {
+		return vol, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "failed to get volume %s", name)
+	}
+	err = c.call("get volume "+name, func(ctx context.Context) error {
+		var err error
+		vol, err = c.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return vol, err
+}
+
+// restoreOperation identifies the Longhorn volume restored for a PVC by the
+// restore item action.
+type restoreOperation struct {
+	pvcNamespace string
+	pvcName      string
+	volumeName   string
+}
+
+// String encodes the operation as the operation ID handed to Velero.
+func (o restoreOperation) String() string {
+	return strings.Join([]string{o.pvcNamespace, o.pvcName, o.volumeName}, "/")
+}
+
+// parseRestoreOperation decodes an operation ID built by restoreOperation.String.
+func parseRestoreOperation(operationID string) (restoreOperation, error) {
+	parts := strings.Split(operationID, "/")
+	if len(parts) != 3 {
+		return restoreOperation{}, riav2.InvalidOperationIDError(operationID)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return restoreOperation{}, riav2.InvalidOperationIDError(operationID)
+		}
+	}
+	return restoreOperation{pvcNamespace: parts[0], pvcName: parts[1], volumeName: parts[2]}, nil
+}
+
+// createVolume creates the Volume CR. Its name is derived from the restore,
+// so an AlreadyExists error means an earlier attempt did create it.
+func (c *longhornClient) createVolume(volume *longhorn.Volume) error {
+	return c.call("create volume "+volume.Name, func(ctx context.Context) error {
+		_, err := c.lh.LonghornV1beta2().Volumes(longhornNamespace).Create(ctx, volume, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// deleteVolume deletes the Volume CR, treating an already deleted one as success.
+func (c *longhornClient) deleteVolume(name string) error {
+	return c.call("delete volume "+name, func(ctx context.Context) error {
+		err := c.lh.LonghornV1beta2().Volumes(longhornNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// createPersistentVolume creates the PV, with the same AlreadyExists handling
+// as createVolume.
+func (c *longhornClient) createPersistentVolume(pv *corev1api.PersistentVolume) error {
+	return c.call("create persistent volume "+pv.Name, func(ctx context.Context) error {
+		_, err := c.k8s.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// deletePersistentVolume deletes the PV, treating an already deleted one as success.
+func (c *longhornClient) deletePersistentVolume(name string) error {
+	return c.call("delete persistent volume "+name, func(ctx context.Context) error {
+		err := c.k8s.CoreV1().PersistentVolumes().Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// volumeRestore is how far Longhorn got restoring a volume from its backup.
+type volumeRestore struct {
+	done     bool
+	progress int
+	failure  string
+}
+
+// volumeRestoreStatus reports how far Longhorn got restoring the data of the
+// volume. An RWX volume is only done once Longhorn also detached it after
+// the restore: its share manager can only start serving it when a workload
+// attaches it, which happens after the restore.
+func (c *longhornCache) volumeRestoreStatus(vol *longhorn.Volume) (volumeRestore, error) {
+	status, err := c.dataRestoreStatus(vol)
+	if err != nil || !status.done {
+		return status, err
+	}
+	if vol.Spec.AccessMode == longhorn.AccessModeReadWriteMany && !vol.Spec.Standby &&
+		vol.Status.State != longhorn.VolumeStateDetached {
+		status.done = false
+	}
+	return status, nil
+}
+
+// dataRestoreStatus reads the restore state of the volume from its Restore
+// condition and, while the restore runs, from the restore status of its engine.
+// A volume being activated is done once Longhorn no longer needs to restore it.
+// A volume cloned from a snapshot is done once its clone completes.
+func (c *longhornCache) dataRestoreStatus(vol *longhorn.Volume) (volumeRestore, error) {
+	if vol.Spec.FromBackup == "" && vol.Spec.DataSource != "" {
+		switch vol.Status.CloneStatus.State {
+		case longhorn.VolumeCloneStateCompleted:
+			return volumeRestore{done: true, progress: 100}, nil
+		case longhorn.VolumeCloneStateFailed:
+			return volumeRestore{failure: fmt.Sprintf("clone from %s failed", vol.Spec.DataSource)}, nil
+		}
+		return volumeRestore{}, nil
+	}
+	for _, condition := range vol.Status.Conditions {
+		if condition.Type == longhorn.VolumeConditionTypeRestore && condition.Reason == longhorn.VolumeConditionReasonRestoreFailure {
+			return volumeRestore{failure: condition.Message}, nil
+		}
+	}
+	if vol.Status.RestoreInitiated && !vol.Status.RestoreRequired {
+		return volumeRestore{done: true, progress: 100}, nil
+	}
+
+	engines, err := c.engines.List(labels.SelectorFromSet(labels.Set{engineVolumeLabel: vol.Name}))
+	if err != nil {
+		return volumeRestore{}, errors.Wrapf(err, "failed to list engines of volume %s", vol.Name)
+	}
+	restore := volumeRestore{}
+	replicas, restored := 0, 0
+	for _, engine := range engines {
+		for _, status := range engine.Status.RestoreStatus {
+			if status == nil {
+				continue
+			}
+			if status.Error != "" {
+				return volumeRestore{failure: status.Error}, nil
+			}
+			restore.progress += status.Progress
+			replicas++
+			if !status.IsRestoring && status.LastRestored != "" {
+				restored++
+			}
+		}
+	}
+	if replicas > 0 {
+		restore.progress /= replicas
+	}
+	// A standby volume keeps restoring the newer backups of its backup
+	// volume, so it is done once every replica restored the first one.
+	if vol.Spec.Standby && replicas > 0 && restored == replicas {
+		return volumeRestore{done: true, progress: 100}, nil
+	}
+	return restore, nil
+}
@@ -0,0 +1,154 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	riav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/restoreitemaction/v2"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+func TestParseRestoreOperation(t *testing.T) {
+	tests := []struct {
+		name        string
+		operationID string
+		want        restoreOperation
+		wantErr     bool
+	}{
+		{
+			name:        "valid",
+			operationID: "ns/data/restore-1234-pvc-1",
+			want:        restoreOperation{pvcNamespace: "ns", pvcName: "data", volumeName: "restore-1234-pvc-1"},
+		},
+		{name: "empty", operationID: "", wantErr: true},
+		{name: "too few parts", operationID: "ns/data", wantErr: true},
+		{name: "too many parts", operationID: "ns/data/vol/extra", wantErr: true},
+		{name: "empty part", operationID: "ns/data/", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			op, err := parseRestoreOperation(tc.operationID)
+			if tc.wantErr {
+				assert.Equal(t, riav2.InvalidOperationIDError(tc.operationID), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, op)
+			assert.Equal(t, tc.operationID, op.String())
+		})
+	}
+}
+
+func TestVolumeRestoreStatus(t *testing.T) {
+	fromBackup := func(accessMode longhorn.AccessMode, state longhorn.VolumeState) *longhorn.Volume {
+		return &longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "vol"},
+			Spec:       longhorn.VolumeSpec{FromBackup: testBackupURL(testBackupTarget, "backup-1", "pvc-1"), AccessMode: accessMode},
+			Status:     longhorn.VolumeStatus{State: state, RestoreInitiated: true},
+		}
+	}
+	cloned := func(accessMode longhorn.AccessMode, state longhorn.VolumeState, clone longhorn.VolumeCloneState) *longhorn.Volume {
+		return &longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "vol"},
+			Spec:       longhorn.VolumeSpec{DataSource: snapshotDataSource("pvc-1", "snap-1"), AccessMode: accessMode},
+			Status:     longhorn.VolumeStatus{State: state, CloneStatus: longhorn.VolumeCloneStatus{State: clone}},
+		}
+	}
+	restoring := fromBackup(longhorn.AccessModeReadWriteOnce, longhorn.VolumeStateAttached)
+	restoring.Status.RestoreRequired = true
+	failed := fromBackup(longhorn.AccessModeReadWriteOnce, longhorn.VolumeStateAttached)
+	failed.Status.RestoreRequired = true
+	failed.Status.Conditions = []longhorn.Condition{{
+		Type:    longhorn.VolumeConditionTypeRestore,
+		Reason:  longhorn.VolumeConditionReasonRestoreFailure,
+		Message: "backup not found",
+	}}
+	standby := fromBackup(longhorn.AccessModeReadWriteMany, longhorn.VolumeStateAttached)
+	standby.Spec.Standby = true
+	standby.Status.RestoreRequired = true
+
+	engine := func(restoreStatus ...*longhorn.RestoreStatus) *longhorn.Engine {
+		e := &longhorn.Engine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "vol-e-0", Labels: map[string]string{engineVolumeLabel: "vol"}},
+			Status:     longhorn.EngineStatus{RestoreStatus: map[string]*longhorn.RestoreStatus{}},
+		}
+		for i, status := range restoreStatus {
+			e.Status.RestoreStatus[string(rune('a'+i))] = status
+		}
+		return e
+	}
+
+	tests := []struct {
+		name   string
+		volume *longhorn.Volume
+		engine *longhorn.Engine
+		want   volumeRestore
+	}{
+		{name: "restored RWO", volume: fromBackup(longhorn.AccessModeReadWriteOnce, longhorn.VolumeStateAttached), want: volumeRestore{done: true, progress: 100}},
+		{name: "restored RWX still attached", volume: fromBackup(longhorn.AccessModeReadWriteMany, longhorn.VolumeStateAttached), want: volumeRestore{progress: 100}},
+		{name: "restored RWX detached", volume: fromBackup(longhorn.AccessModeReadWriteMany, longhorn.VolumeStateDetached), want: volumeRestore{done: true, progress: 100}},
+		{
+			name:   "restoring",
+			volume: restoring,
+			engine: engine(&longhorn.RestoreStatus{IsRestoring: true, Progress: 20}, &longhorn.RestoreStatus{IsRestoring: true, Progress: 60}),
+			want:   volumeRestore{progress: 40},
+		},
+		{
+			name:   "engine restore error",
+			volume: restoring,
+			engine: engine(&longhorn.RestoreStatus{Error: "disk full"}),
+			want:   volumeRestore{failure: "disk full"},
+		},
+		{name: "restore failed", volume: failed, want: volumeRestore{failure: "backup not found"}},
+		{
+			name:   "RWX standby restored its first backup",
+			volume: standby,
+			engine: engine(&longhorn.RestoreStatus{LastRestored: "backup-1", Progress: 100}),
+			want:   volumeRestore{done: true, progress: 100},
+		},
+		{name: "clone in progress", volume: cloned(longhorn.AccessModeReadWriteOnce, longhorn.VolumeStateAttached, longhorn.VolumeCloneStateInitiated), want: volumeRestore{}},
+		{name: "cloned RWO", volume: cloned(longhorn.AccessModeReadWriteOnce, longhorn.VolumeStateAttached, longhorn.VolumeCloneStateCompleted), want: volumeRestore{done: true, progress: 100}},
+		{name: "cloned RWX still attached", volume: cloned(longhorn.AccessModeReadWriteMany, longhorn.VolumeStateAttached, longhorn.VolumeCloneStateCompleted), want: volumeRestore{progress: 100}},
+		{name: "cloned RWX detached", volume: cloned(longhorn.AccessModeReadWriteMany, longhorn.VolumeStateDetached, longhorn.VolumeCloneStateCompleted), want: volumeRestore{done: true, progress: 100}},
+		{
+			name:   "clone failed",
+			volume: cloned(longhorn.AccessModeReadWriteOnce, longhorn.VolumeStateDetached, longhorn.VolumeCloneStateFailed),
+			want:   volumeRestore{failure: "clone from snap://pvc-1/snap-1 failed"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tc.engine != nil {
+				objects = append(objects, tc.engine)
+			}
+			client, _ := newFakeLonghornClient(objects...)
+			lhCache := newFakeLonghornCache(t, client)
+			status, err := lhCache.volumeRestoreStatus(tc.volume)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, status)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// restoreFromAnnotation on a PVC restores it from a Longhorn backup that
+// Velero did not take, such as one made by a recurring job. It holds either
+// the URL of the backup or the name of its Backup CR, optionally prefixed
+// with the name of its BackupVolume or volume: "<backup volume>/<backup>".
+const restoreFromAnnotation = "velero.io/longhorn-restore-from"
+
+// longhornBackupReference is a Longhorn backup to restore a PVC from.
+type longhornBackupReference struct {
+	name string
+	url  string
+	// volumeSize is the size of the backed up volume in bytes, or 0 if unknown.
+	volumeSize int64
+}
+
+// resolveBackupReference looks up the Longhorn backup ref refers to, in the
+// format of restoreFromAnnotation. A URL is used as is; a backup named by its
+// CR must be completed.
+func (c *longhornCache) resolveBackupReference(ref string) (longhornBackupReference, error) {
+	if strings.Contains(ref, "://") {
+		return longhornBackupReference{name: ref, url: ref}, nil
+	}
+
+	volumeName, backupName, scoped := strings.Cut(ref, "/")
+	if !scoped {
+		volumeName, backupName = "", ref
+	}
+	if backupName == "" || strings.Contains(backupName, "/") {
+		return longhornBackupReference{}, errors.Errorf("invalid %s %q: must be a backup URL, <backup> or <backup volume>/<backup>", restoreFromAnnotation, ref)
+	}
+	if volumeName != "" {
+		// BackupVolume CRs are not named after their volume on every Longhorn
+		// version, so accept either name.
+		backupVolume, err := c.backupVolumes.Get(volumeName)
+		switch {
+		case err == nil:
+			volumeName = backupVolume.Spec.VolumeName
+		case !apierrors.IsNotFound(err):
+			return longhornBackupReference{}, errors.Wrapf(err, "failed to get backup volume %s", volumeName)
+		}
+	}
+
+	backup, err := c.backups.Get(backupName)
+	if err != nil {
+		return longhornBackupReference{}, errors.Wrapf(err, "failed to get Longhorn backup %s", backupName)
+	}
+	if volumeName != "" && backup.Status.VolumeName != volumeName && backup.Labels[backupVolumeLabel] != volumeName {
+		return longhornBackupReference{}, errors.Errorf("Longhorn backup %s is not a backup of volume %s", backupName, volumeName)
+	}
+	if backup.Status.State != longhorn.BackupStateCompleted || backup.Status.URL == "" {
+		return longhornBackupReference{}, errors.Errorf("Longhorn backup %s is %s, not %s", backupName, backup.Status.State, longhorn.BackupStateCompleted)
+	}
+	return backupReference(backup), nil
+}
+
+// backupReference returns a reference to the Longhorn backup.
+func backupReference(backup *longhorn.Backup) longhornBackupReference {
+	ref := longhornBackupReference{name: backup.Name, url: backup.Status.URL}
+	ref.volumeSize, _ = strconv.ParseInt(backup.Status.VolumeSize, 10, 64)
+	return ref
+}
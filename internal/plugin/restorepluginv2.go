@@ -0,0 +1,584 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework/common"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// RestorePluginV2 is a v2 restore item action plugin for Velero. It restores
+// the data of Longhorn PVCs backed up by BackupPluginV2 from the Longhorn
+// backup target, and maps Longhorn PVs and PVCs to the target cluster.
+type RestorePluginV2 struct {
+	log    logrus.FieldLogger
+	client *longhornClient
+	cache  *longhornCache
+	config map[string]string
+
+	volumeMappings []*volumeMapping
+
+	preflightsLock sync.Mutex
+	preflights     map[types.UID]map[string]bool
+}
+
+// NewRestorePluginV2 instantiates a v2 RestorePlugin.
+func NewRestorePluginV2(log logrus.FieldLogger) *RestorePluginV2 {
+	return &RestorePluginV2{log: log}
+}
+
+// Name is required to implement the interface, but the Velero pod does not delegate this
+// method -- it's used to tell velero what name it was registered under. The plugin implementation
+// must define it, but it will never actually be called.
+func (p *RestorePluginV2) Name() string {
+	return "longhornRestorePlugin"
+}
+
+// AppliesTo returns information about which resources this action should be invoked for.
+func (p *RestorePluginV2) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{
+			kuberesource.PersistentVolumeClaims.String(),
+			kuberesource.PersistentVolumes.String(),
+		},
+	}, nil
+}
+
+// init creates the API client and the shared cache on first use, since
+// restore item actions have no Init hook.
+func (p *RestorePluginV2) init() error {
+	if p.client == nil {
+		client, err := newLonghornClient(p.log, nil)
+		if err != nil {
+			return err
+		}
+		p.client = client
+	}
+	if p.cache == nil {
+		lhCache, err := getLonghornCache(p.client)
+		if err != nil {
+			return err
+		}
+		p.cache = lhCache
+	}
+	if p.config == nil {
+		config, err := p.client.getPluginConfig(common.PluginKindRestoreItemActionV2, RestorePluginV2Name)
+		if err != nil {
+			return err
+		}
+		if err := p.client.configure(config); err != nil {
+			return err
+		}
+		if p.volumeMappings, err = parseVolumeMappings(config); err != nil {
+			return err
+		}
+		p.config = config
+	}
+	return nil
+}
+
+// Execute applies the configured volume mappings to Longhorn PVs and PVCs,
+// and restores the Longhorn volume of PVCs whose data the backup action
+// backed up to the Longhorn backup target.
+func (p *RestorePluginV2) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	switch kind := input.Item.GetObjectKind().GroupVersionKind().Kind; kind {
+	case "PersistentVolume":
+		return p.restorePersistentVolume(input)
+	case "PersistentVolumeClaim":
+		return p.restorePersistentVolumeClaim(input)
+	default:
+		return nil, errors.Errorf("unexpected item kind %s", kind)
+	}
+}
+
+// restorePersistentVolume applies the matching volume mapping to a Longhorn
+// PV, including the Longhorn volume recreated for it from a Velero snapshot.
+func (p *RestorePluginV2) restorePersistentVolume(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	pv := new(corev1api.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	volumeName := longhornVolumeName(pv)
+	if volumeName == "" {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+
+	// Velero already remapped the namespace of the claim on the item, and
+	// mappings match the namespace the PVC was backed up from.
+	backupPV := new(corev1api.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.ItemFromBackup.UnstructuredContent(), backupPV); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sourceNamespace := ""
+	if backupPV.Spec.ClaimRef != nil {
+		sourceNamespace = backupPV.Spec.ClaimRef.Namespace
+	}
+	mapping := findVolumeMapping(p.volumeMappings, pv.Spec.StorageClassName, sourceNamespace, pv.Labels)
+	if mapping == nil {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if err := p.mapRecreatedVolume(volumeName, mapping); err != nil {
+		return nil, err
+	}
+	if mapping.StorageClass == "" {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	p.log.Infof("Mapping storage class of persistent volume %s from %s to %s", pv.Name, pv.Spec.StorageClassName, mapping.StorageClass)
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	pv.Annotations[sourceStorageClassAnnotation] = pv.Spec.StorageClassName
+	pv.Spec.StorageClassName = mapping.StorageClass
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	input.Item.SetUnstructuredContent(item)
+	return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+}
+
+// mapRecreatedVolume applies mapping to a Longhorn volume the restore created.
+// Volumes that were not recreated, like the one behind a retained PV, are
+// left alone.
+func (p *RestorePluginV2) mapRecreatedVolume(volumeName string, mapping *volumeMapping) error {
+	vol, err := p.cache.volumes.Get(volumeName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get volume %s", volumeName)
+	}
+	if _, ok := vol.Labels[sourceVolumeLabel]; !ok {
+		return nil
+	}
+	return p.client.call("update volume "+volumeName, func(ctx context.Context) error {
+		vol, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(ctx, volumeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		mapping.applyToSpec(&vol.Spec)
+		_, err = p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Update(ctx, vol, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// restorePersistentVolumeClaim applies the matching volume mapping to a
+// Longhorn PVC. For a PVC whose data the backup action backed up, it creates
+// a volume restoring the recorded Longhorn backup and a PV for it, points
+// the PVC at that PV, and returns an operation that completes once Longhorn
+// has restored the data. The volume is a standby volume if so configured.
+// A restore asking to activate standby volumes activates the one behind the
+// PVC instead.
+func (p *RestorePluginV2) restorePersistentVolumeClaim(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	pvc := new(corev1api.PersistentVolumeClaim)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pvc); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !isLonghornPVC(pvc) {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+
+	activate, err := activateStandbyRequested(input.Restore)
+	if err != nil {
+		return nil, err
+	}
+	if activate {
+		op, ok, err := p.activateStandbyVolume(pvc)
+		if err != nil || !ok {
+			return velero.NewRestoreItemActionExecuteOutput(input.Item), err
+		}
+		// The PVC exists, so Velero leaves it alone after this.
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithOperationID(op.String()), nil
+	}
+
+	backupMetadata, err := meta.Accessor(input.ItemFromBackup)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	storageClass := ""
+	if pvc.Spec.StorageClassName != nil {
+		storageClass = *pvc.Spec.StorageClassName
+	}
+	mapping := findVolumeMapping(p.volumeMappings, storageClass, backupMetadata.GetNamespace(), pvc.Labels)
+	if mapping != nil && mapping.StorageClass != "" {
+		p.log.Infof("Mapping storage class of PVC %s/%s from %s to %s", pvc.Namespace, pvc.Name, storageClass, mapping.StorageClass)
+		pvc.Spec.StorageClassName = &mapping.StorageClass
+	}
+
+	operationID := ""
+	restoreBackup := p.restoresLonghornBackup(pvc, input.Restore)
+	if restoreBackup && pvc.Annotations[restoreFromAnnotation] == "" {
+		fromSnapshot, err := p.restoredFromSnapshot(pvc, input.Restore)
+		if err != nil {
+			return nil, err
+		}
+		if fromSnapshot {
+			p.log.Infof("Persistent volume %s of PVC %s/%s was restored from its snapshot, skipping its Longhorn backup", pvc.Spec.VolumeName, pvc.Namespace, pvc.Name)
+			restoreBackup = false
+		}
+	}
+	if restoreBackup {
+		op, err := p.startRestore(pvc, input.Restore, mapping)
+		if err != nil {
+			return nil, err
+		}
+		pvc.Spec.VolumeName = op.volumeName
+		operationID = op.String()
+	}
+
+	item, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pvc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	input.Item.SetUnstructuredContent(item)
+	return velero.NewRestoreItemActionExecuteOutput(input.Item).WithOperationID(operationID), nil
+}
+
+// isLonghornPVC reports whether pvc was provisioned by the Longhorn CSI driver,
+// had its data backed up by the backup action or references a Longhorn backup.
+func isLonghornPVC(pvc *corev1api.PersistentVolumeClaim) bool {
+	return pvc.Annotations["volume.kubernetes.io/storage-provisioner"] == longhornDriverName ||
+		pvc.Annotations["volume.beta.kubernetes.io/storage-provisioner"] == longhornDriverName ||
+		pvc.Annotations[longhornBackupURLAnnotation] != "" ||
+		pvc.Annotations[restoreFromAnnotation] != ""
+}
+
+// restoresLonghornBackup reports whether the data of pvc is restored from a
+// Longhorn backup: one the backup action recorded on it, or one its
+// restoreFromAnnotation references.
+func (p *RestorePluginV2) restoresLonghornBackup(pvc *corev1api.PersistentVolumeClaim, restore *v1.Restore) bool {
+	if restore.Spec.RestorePVs != nil && !*restore.Spec.RestorePVs {
+		return false
+	}
+	if pvc.Annotations[restoreFromAnnotation] != "" {
+		return true
+	}
+	return pvc.Annotations[longhornBackupURLAnnotation] != "" &&
+		pvc.Annotations[longhornBackupStateAnnotation] == string(longhorn.BackupStateCompleted)
+}
+
+// restoredFromSnapshot reports whether the restore already recreated the PV
+// of pvc from a Velero native snapshot, which happens when the backup took
+// both a snapshot and a Longhorn backup of the volume. Velero restores PVs
+// before PVCs, so the PV is in the cluster by now, possibly renamed.
+func (p *RestorePluginV2) restoredFromSnapshot(pvc *corev1api.PersistentVolumeClaim, restore *v1.Restore) (bool, error) {
+	if pvc.Spec.VolumeName == "" {
+		return false, nil
+	}
+	pv, err := p.client.findRestoredPersistentVolume(pvc.Spec.VolumeName, restore)
+	if err != nil || pv == nil {
+		return false, err
+	}
+	volumeName := longhornVolumeName(pv)
+	if volumeName == "" {
+		return false, nil
+	}
+	vol, err := p.client.getVolume(p.cache, volumeName)
+	if err != nil || vol == nil {
+		return false, err
+	}
+	if _, ok := vol.Labels[sourceVolumeLabel]; !ok || vol.Labels[v1.RestoreUIDLabel] != "" {
+		return false, nil
+	}
+	return restoredBy(vol, restore), nil
+}
+
+// startRestore creates a volume restoring the Longhorn backup of pvc and a PV
+// for it, pre-bound to pvc.
+func (p *RestorePluginV2) startRestore(pvc *corev1api.PersistentVolumeClaim, restore *v1.Restore, mapping *volumeMapping) (restoreOperation, error) {
+	ref, err := p.longhornBackupToRestore(pvc, restore)
+	if err != nil {
+		return restoreOperation{}, err
+	}
+	// A PVC referencing a backup Velero did not take may have no PV.
+	pvName := pvc.Spec.VolumeName
+	if pvName == "" {
+		pvName = backupURLVolumeName(ref.url)
+	}
+	if pvName == "" {
+		return restoreOperation{}, errors.Errorf("PVC %s/%s has a Longhorn backup but no persistent volume", pvc.Namespace, pvc.Name)
+	}
+	backupURL := ref.url
+
+	params, err := volumeParamsFromAnnotations(pvc.Annotations)
+	if err != nil {
+		return restoreOperation{}, err
+	}
+	if params == nil {
+		params = pvcVolumeParams(pvc)
+	}
+	// The volume may have grown since the PVC was backed up.
+	if ref.volumeSize > params.Size {
+		params.Size = ref.volumeSize
+	}
+
+	volumeName, err := p.restoreVolumeName(pvName, restore)
+	if err != nil {
+		return restoreOperation{}, err
+	}
+	op := restoreOperation{
+		pvcNamespace: pvc.Namespace,
+		pvcName:      pvc.Name,
+		volumeName:   volumeName,
+	}
+	restoreLabels := map[string]string{
+		v1.RestoreNameLabel: label.GetValidName(restore.Name),
+		v1.RestoreUIDLabel:  string(restore.UID),
+	}
+	log := p.log.WithField("pvc", pvc.Namespace+"/"+pvc.Name).WithField("volume", op.volumeName)
+
+	volume := &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   op.volumeName,
+			Labels: map[string]string{sourceVolumeLabel: backupURLVolumeName(backupURL)},
+		},
+		Spec: params.spec(),
+	}
+	for k, v := range restoreLabels {
+		volume.Labels[k] = v
+	}
+	volume.Spec.FromBackup = backupURL
+	if mapping != nil {
+		mapping.applyToSpec(&volume.Spec)
+	}
+	standby, err := p.standbyEnabled(restore)
+	if err != nil {
+		return op, err
+	}
+	if standby {
+		// Standby volumes have no frontend until they are activated.
+		volume.Spec.Standby = true
+		volume.Spec.Frontend = ""
+	}
+	if err := p.checkCapacity(volume, restore); err != nil {
+		return op, err
+	}
+	log.Infof("Restoring Longhorn backup %s", ref.name)
+	if err := p.client.createVolume(volume); err != nil {
+		return op, err
+	}
+	if err := p.client.createPersistentVolume(restoredPersistentVolume(op.volumeName, pvc, params, restoreLabels)); err != nil {
+		return op, err
+	}
+	return op, nil
+}
+
+// longhornBackupToRestore returns the Longhorn backup to restore pvc from:
+// the one its restoreFromAnnotation references or, failing that, the one
+// the Velero backup recorded on it or the newer backup of the same volume
+// the restore point selects.
+func (p *RestorePluginV2) longhornBackupToRestore(pvc *corev1api.PersistentVolumeClaim, restore *v1.Restore) (longhornBackupReference, error) {
+	if ref := pvc.Annotations[restoreFromAnnotation]; ref != "" {
+		return p.cache.resolveBackupReference(ref)
+	}
+
+	recorded := longhornBackupReference{
+		name: pvc.Annotations[longhornBackupNameAnnotation],
+		url:  pvc.Annotations[longhornBackupURLAnnotation],
+	}
+	point, err := p.restorePoint(restore)
+	if err != nil {
+		return longhornBackupReference{}, err
+	}
+	lhBackup, err := p.cache.selectBackup(recorded.url, point)
+	if err != nil || lhBackup == nil {
+		return recorded, err
+	}
+	return backupReference(lhBackup), nil
+}
+
+// restoreVolumeName returns the name of the volume and PV restoring the PV
+// pvName. It is the original name if preserveVolumeNames is set and the name
+// is free, and a name unique to the restore otherwise.
+func (p *RestorePluginV2) restoreVolumeName(pvName string, restore *v1.Restore) (string, error) {
+	preserve, err := boolConfig(p.config, preserveVolumeNamesConfigKey, false)
+	if err != nil {
+		return "", err
+	}
+	if preserve {
+		available, err := p.client.volumeNameAvailable(pvName, restore.UID)
+		if err != nil {
+			return "", err
+		}
+		if available {
+			return pvName, nil
+		}
+		p.log.Infof("Volume name %s is taken, restoring under a new name", pvName)
+	}
+	return restoredVolumeName(restore.UID, pvName), nil
+}
+
+// pvcVolumeParams returns the parameters of a volume for pvc, for PVCs backed
+// up before the backup action recorded the parameters of their volume.
+// Settings the PVC says nothing about are left to Longhorn's defaults.
+func pvcVolumeParams(pvc *corev1api.PersistentVolumeClaim) *volumeParams {
+	params := &volumeParams{
+		AccessMode: longhorn.AccessModeReadWriteOnce,
+	}
+	if size, ok := pvc.Spec.Resources.Requests[corev1api.ResourceStorage]; ok {
+		params.Size = size.Value()
+	}
+	for _, mode := range pvc.Spec.AccessModes {
+		if mode == corev1api.ReadWriteMany {
+			params.AccessMode = longhorn.AccessModeReadWriteMany
+		}
+	}
+	return params
+}
+
+// restoredPersistentVolume returns a PV for the Longhorn volume volumeName,
+// pre-bound to pvc.
+func restoredPersistentVolume(volumeName string, pvc *corev1api.PersistentVolumeClaim, params *volumeParams, labels map[string]string) *corev1api.PersistentVolume {
+	pv := &corev1api.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        volumeName,
+			Labels:      labels,
+			Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": longhornDriverName},
+		},
+		Spec: corev1api.PersistentVolumeSpec{
+			Capacity: corev1api.ResourceList{
+				corev1api.ResourceStorage: *resource.NewQuantity(params.Size, resource.BinarySI),
+			},
+			AccessModes:                   pvc.Spec.AccessModes,
+			PersistentVolumeReclaimPolicy: corev1api.PersistentVolumeReclaimDelete,
+			VolumeMode:                    pvc.Spec.VolumeMode,
+			ClaimRef: &corev1api.ObjectReference{
+				Kind:       "PersistentVolumeClaim",
+				APIVersion: "v1",
+				Namespace:  pvc.Namespace,
+				Name:       pvc.Name,
+			},
+			PersistentVolumeSource: corev1api.PersistentVolumeSource{
+				CSI: &corev1api.CSIPersistentVolumeSource{
+					Driver:       longhornDriverName,
+					VolumeHandle: volumeName,
+					FSType:       params.FSType,
+				},
+			},
+		},
+	}
+	if pvc.Spec.StorageClassName != nil {
+		pv.Spec.StorageClassName = *pvc.Spec.StorageClassName
+	}
+	return pv
+}
+
+// Progress reports how far Longhorn got restoring the volume of an operation
+// started by Execute.
+func (p *RestorePluginV2) Progress(operationID string, restore *v1.Restore) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+	op, err := parseRestoreOperation(operationID)
+	if err != nil {
+		return progress, err
+	}
+	if err := p.init(); err != nil {
+		return progress, err
+	}
+
+	vol, err := p.client.getVolume(p.cache, op.volumeName)
+	if err != nil {
+		return progress, err
+	}
+	if vol == nil {
+		// Execute creates the volume before it hands out the operation, so a
+		// missing one is a stale read; report the restore as not started.
+		progress.Updated = time.Now()
+		progress.OperationUnits = "bytes"
+		return progress, nil
+	}
+	status, err := p.cache.volumeRestoreStatus(vol)
+	if err != nil {
+		return progress, err
+	}
+
+	progress.Started = vol.CreationTimestamp.Time
+	progress.Updated = time.Now()
+	progress.OperationUnits = "bytes"
+	progress.NTotal = vol.Spec.Size
+	progress.NCompleted = vol.Spec.Size * int64(status.progress) / 100
+	switch {
+	case status.failure != "":
+		progress.Completed = true
+		progress.Err = fmt.Sprintf("Longhorn restore of volume %s for PVC %s/%s failed: %s", op.volumeName, op.pvcNamespace, op.pvcName, status.failure)
+	case status.done:
+		progress.Completed = true
+		progress.NCompleted = progress.NTotal
+	}
+	return progress, nil
+}
+
+// Cancel stops an in-flight restore started by Execute by deleting the PV and
+// the Longhorn volume it created. Volumes the restore did not create, like
+// activated standby volumes, are left alone. Cancelling an operation twice is
+// a no-op.
+func (p *RestorePluginV2) Cancel(operationID string, restore *v1.Restore) error {
+	op, err := parseRestoreOperation(operationID)
+	if err != nil {
+		return err
+	}
+	if err := p.init(); err != nil {
+		return err
+	}
+	log := p.log.WithField("volume", op.volumeName)
+
+	vol, err := p.cache.volumes.Get(op.volumeName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get volume %s", op.volumeName)
+	}
+	if vol != nil && vol.Labels[v1.RestoreNameLabel] != label.GetValidName(restore.Name) {
+		log.Info("Longhorn volume was not created by this restore, nothing to cancel")
+		return nil
+	}
+	log.Infof("Cancelling Longhorn restore for PVC %s/%s", op.pvcNamespace, op.pvcName)
+	if err := p.client.deletePersistentVolume(op.volumeName); err != nil {
+		return err
+	}
+	return p.client.deleteVolume(op.volumeName)
+}
+
+// AreAdditionalItemsReady always reports true, since the action returns no additional items.
+func (p *RestorePluginV2) AreAdditionalItemsReady(additionalItems []velero.ResourceIdentifier, restore *v1.Restore) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,380 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const testBackupTarget = "s3://backups@us-east-1/"
+
+// newTestRestorePlugin returns a RestorePluginV2 running against fake
+// clientsets seeded with objects.
+func newTestRestorePlugin(t *testing.T, config map[string]string, objects ...runtime.Object) *RestorePluginV2 {
+	client, _ := newFakeLonghornClient(objects...)
+	if config == nil {
+		config = map[string]string{}
+	}
+	return &RestorePluginV2{
+		log:    client.log,
+		client: client,
+		cache:  newFakeLonghornCache(t, client),
+		config: config,
+	}
+}
+
+// testRestore returns a restore of the backup "nightly" started a minute ago.
+func testRestore() *v1.Restore {
+	started := metav1.NewTime(time.Now().Add(-time.Minute))
+	return &v1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "restore-1", UID: "restore-uid-1"},
+		Spec:       v1.RestoreSpec{BackupName: "nightly"},
+		Status:     v1.RestoreStatus{StartTimestamp: &started},
+	}
+}
+
+// testLonghornPV returns a PV of the Longhorn volume volumeName.
+func testLonghornPV(name, volumeName string) *corev1api.PersistentVolume {
+	return &corev1api.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1api.PersistentVolumeSpec{
+			Capacity: corev1api.ResourceList{corev1api.ResourceStorage: *resource.NewQuantity(gi, resource.BinarySI)},
+			PersistentVolumeSource: corev1api.PersistentVolumeSource{
+				CSI: &corev1api.CSIPersistentVolumeSource{Driver: longhornDriverName, VolumeHandle: volumeName},
+			},
+		},
+	}
+}
+
+// testSnapshotRestoredPV returns the PV, and its Longhorn volume, that
+// restore recreated the backed up PV pvName as from a snapshot, renamed the
+// way SetVolumeID renames it.
+func testSnapshotRestoredPV(pvName string, restore *v1.Restore) (*corev1api.PersistentVolume, *longhorn.Volume) {
+	pv := testLonghornPV("velero-vol-abc", "velero-vol-abc")
+	pv.Labels = map[string]string{v1.RestoreNameLabel: restore.Name}
+	pv.Annotations = map[string]string{originalPVNameAnnotation: pvName}
+	vol := &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         longhornNamespace,
+			Name:              "velero-vol-abc",
+			Labels:            map[string]string{sourceVolumeLabel: pvName},
+			CreationTimestamp: metav1.Now(),
+		},
+		Spec: longhorn.VolumeSpec{Size: gi, DataSource: snapshotDataSource(pvName, "velero-snap-abc")},
+	}
+	return pv, vol
+}
+
+// testBackedUpPVC returns the item of a PVC whose Longhorn volume pvc-1 the
+// backup action backed up to the Longhorn backup target.
+func testBackedUpPVC(t *testing.T) *unstructured.Unstructured {
+	pvc := &corev1api.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "app",
+			Name:      "data",
+			Annotations: map[string]string{
+				"volume.kubernetes.io/storage-provisioner": longhornDriverName,
+				longhornBackupNameAnnotation:               "backup-1",
+				longhornBackupURLAnnotation:                testBackupURL(testBackupTarget, "backup-1", "pvc-1"),
+				longhornBackupStateAnnotation:              string(longhorn.BackupStateCompleted),
+			},
+		},
+		Spec: corev1api.PersistentVolumeClaimSpec{
+			AccessModes: []corev1api.PersistentVolumeAccessMode{corev1api.ReadWriteOnce},
+			Resources: corev1api.VolumeResourceRequirements{
+				Requests: corev1api.ResourceList{corev1api.ResourceStorage: *resource.NewQuantity(gi, resource.BinarySI)},
+			},
+			VolumeName: "pvc-1",
+		},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pvc)
+	require.NoError(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+// executeRestore runs the restore item action on item as restore would.
+func executeRestore(t *testing.T, p *RestorePluginV2, item *unstructured.Unstructured, restore *v1.Restore) (*velero.RestoreItemActionExecuteOutput, error) {
+	return p.Execute(&velero.RestoreItemActionExecuteInput{
+		Item:           item.DeepCopy(),
+		ItemFromBackup: item.DeepCopy(),
+		Restore:        restore,
+	})
+}
+
+func TestRestorePersistentVolumeClaim(t *testing.T) {
+	t.Run("restores the Longhorn backup", func(t *testing.T) {
+		restore := testRestore()
+		p := newTestRestorePlugin(t, nil, testLonghornPV("pvc-1", "pvc-1"))
+
+		output, err := executeRestore(t, p, testBackedUpPVC(t), restore)
+		require.NoError(t, err)
+		volumeName := restoredVolumeName(restore.UID, "pvc-1")
+		assert.Equal(t, "app/data/"+volumeName, output.OperationID)
+		assert.Equal(t, volumeName, output.UpdatedItem.UnstructuredContent()["spec"].(map[string]interface{})["volumeName"])
+
+		vol, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(context.Background(), volumeName, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, testBackupURL(testBackupTarget, "backup-1", "pvc-1"), vol.Spec.FromBackup)
+		assert.Equal(t, string(restore.UID), vol.Labels[v1.RestoreUIDLabel])
+		pv, err := p.client.k8s.CoreV1().PersistentVolumes().Get(context.Background(), volumeName, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "data", pv.Spec.ClaimRef.Name)
+	})
+
+	t.Run("skips a PV restored from a snapshot under a new name", func(t *testing.T) {
+		restore := testRestore()
+		renamedPV, clone := testSnapshotRestoredPV("pvc-1", restore)
+		// The original PV is still in the cluster, which is why Velero renamed the restored one.
+		p := newTestRestorePlugin(t, nil, testLonghornPV("pvc-1", "pvc-1"), renamedPV, clone)
+
+		output, err := executeRestore(t, p, testBackedUpPVC(t), restore)
+		require.NoError(t, err)
+		assert.Empty(t, output.OperationID)
+		assert.Equal(t, "pvc-1", output.UpdatedItem.UnstructuredContent()["spec"].(map[string]interface{})["volumeName"])
+
+		volumes, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Len(t, volumes.Items, 1)
+	})
+
+	t.Run("restores over a snapshot restored by another restore", func(t *testing.T) {
+		restore := testRestore()
+		renamedPV, clone := testSnapshotRestoredPV("pvc-1", restore)
+		renamedPV.Labels[v1.RestoreNameLabel] = "restore-0"
+		p := newTestRestorePlugin(t, nil, renamedPV, clone)
+
+		output, err := executeRestore(t, p, testBackedUpPVC(t), restore)
+		require.NoError(t, err)
+		assert.Equal(t, "app/data/"+restoredVolumeName(restore.UID, "pvc-1"), output.OperationID)
+	})
+}
+
+func TestRestoreProgress(t *testing.T) {
+	restore := testRestore()
+	op := restoreOperation{pvcNamespace: "app", pvcName: "data", volumeName: "restored"}
+	volume := func(state longhorn.VolumeState, conditions ...longhorn.Condition) *longhorn.Volume {
+		return &longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "restored", CreationTimestamp: metav1.Now()},
+			Spec:       longhorn.VolumeSpec{Size: gi, FromBackup: testBackupURL(testBackupTarget, "backup-1", "pvc-1")},
+			Status:     longhorn.VolumeStatus{State: state, RestoreInitiated: true, RestoreRequired: len(conditions) > 0, Conditions: conditions},
+		}
+	}
+
+	t.Run("reports a restored volume as completed", func(t *testing.T) {
+		p := newTestRestorePlugin(t, nil, volume(longhorn.VolumeStateAttached))
+
+		progress, err := p.Progress(op.String(), restore)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+		assert.Equal(t, gi, progress.NCompleted)
+		assert.Equal(t, gi, progress.NTotal)
+	})
+
+	t.Run("reports a failed restore", func(t *testing.T) {
+		p := newTestRestorePlugin(t, nil, volume(longhorn.VolumeStateAttached, longhorn.Condition{
+			Type:    longhorn.VolumeConditionTypeRestore,
+			Reason:  longhorn.VolumeConditionReasonRestoreFailure,
+			Message: "backup not found",
+		}))
+
+		progress, err := p.Progress(op.String(), restore)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+		assert.Contains(t, progress.Err, "backup not found")
+	})
+
+	t.Run("reads a volume missing from the cache from the API server", func(t *testing.T) {
+		p := newTestRestorePlugin(t, nil, volume(longhorn.VolumeStateAttached))
+		// A cache of an empty cluster stands in for an informer that has
+		// not seen the volume yet.
+		lagging, _ := newFakeLonghornClient()
+		p.cache = newFakeLonghornCache(t, lagging)
+
+		progress, err := p.Progress(op.String(), restore)
+		require.NoError(t, err)
+		assert.True(t, progress.Completed)
+	})
+
+	t.Run("reports a missing volume as not started", func(t *testing.T) {
+		p := newTestRestorePlugin(t, nil)
+
+		progress, err := p.Progress(op.String(), restore)
+		require.NoError(t, err)
+		assert.False(t, progress.Completed)
+		assert.Empty(t, progress.Err)
+		assert.Zero(t, progress.NCompleted)
+	})
+}
+
+func TestActivateStandbyVolume(t *testing.T) {
+	standbyObjects := func(lastBackup, lastRestored string, restoring bool) []runtime.Object {
+		pvc := &corev1api.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "data"},
+			Spec:       corev1api.PersistentVolumeClaimSpec{VolumeName: "standby"},
+		}
+		vol := &longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "standby"},
+			Spec: longhorn.VolumeSpec{
+				FromBackup: testBackupURL(testBackupTarget, "backup-1", "pvc-1"),
+				Standby:    true,
+			},
+		}
+		backupVolume := &longhorn.BackupVolume{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "pvc-1-6e2c7b4a"},
+			Spec:       longhorn.BackupVolumeSpec{VolumeName: "pvc-1"},
+			Status:     longhorn.BackupVolumeStatus{LastBackupName: lastBackup},
+		}
+		engine := &longhorn.Engine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "standby-e-0", Labels: map[string]string{engineVolumeLabel: "standby"}},
+			Status: longhorn.EngineStatus{
+				LastRestoredBackup: lastRestored,
+				RestoreStatus:      map[string]*longhorn.RestoreStatus{"r-0": {IsRestoring: restoring, LastRestored: lastRestored}},
+			},
+		}
+		return []runtime.Object{pvc, vol, backupVolume, engine}
+	}
+	activateRestore := func() *v1.Restore {
+		restore := testRestore()
+		restore.Annotations = map[string]string{activateStandbyAnnotation: "true"}
+		return restore
+	}
+
+	t.Run("activates a volume that restored the latest backup", func(t *testing.T) {
+		p := newTestRestorePlugin(t, nil, standbyObjects("backup-2", "backup-2", false)...)
+
+		output, err := executeRestore(t, p, testBackedUpPVC(t), activateRestore())
+		require.NoError(t, err)
+		assert.Equal(t, "app/data/standby", output.OperationID)
+
+		vol, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(context.Background(), "standby", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.False(t, vol.Spec.Standby)
+		assert.Equal(t, longhorn.VolumeFrontendBlockDev, vol.Spec.Frontend)
+	})
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+	}{
+		{name: "a volume behind its backup volume", objects: standbyObjects("backup-2", "backup-1", false)},
+		{name: "a volume still restoring", objects: standbyObjects("backup-2", "backup-2", true)},
+		{name: "a volume without its backup volume", objects: standbyObjects("backup-2", "backup-2", false)[:2]},
+	}
+	for _, tc := range tests {
+		t.Run("refuses to activate "+tc.name, func(t *testing.T) {
+			p := newTestRestorePlugin(t, nil, tc.objects...)
+
+			_, err := executeRestore(t, p, testBackedUpPVC(t), activateRestore())
+			assert.ErrorContains(t, err, "cannot activate standby volume standby")
+
+			vol, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(context.Background(), "standby", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.True(t, vol.Spec.Standby)
+		})
+	}
+}
+
+func TestRestorePersistentVolume(t *testing.T) {
+	mappings, err := parseVolumeMappings(map[string]string{volumeMappingsConfigKey: testVolumeMappings})
+	require.NoError(t, err)
+	// pvItem returns the PV of the claim namespace/data as the restore
+	// sees it.
+	pvItem := func(t *testing.T, volumeName, namespace string) *unstructured.Unstructured {
+		pv := testLonghornPV("pvc-1", volumeName)
+		pv.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+		pv.Spec.StorageClassName = "longhorn"
+		pv.Spec.ClaimRef = &corev1api.ObjectReference{Namespace: namespace, Name: "data"}
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+		require.NoError(t, err)
+		return &unstructured.Unstructured{Object: content}
+	}
+	restorePV := func(t *testing.T, p *RestorePluginV2, volumeName string) *corev1api.PersistentVolume {
+		restore := testRestore()
+		restore.Spec.NamespaceMapping = map[string]string{"prod": "prod-dr"}
+		output, err := p.Execute(&velero.RestoreItemActionExecuteInput{
+			Item:           pvItem(t, volumeName, "prod-dr"),
+			ItemFromBackup: pvItem(t, volumeName, "prod"),
+			Restore:        restore,
+		})
+		require.NoError(t, err)
+		pv := new(corev1api.PersistentVolume)
+		require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), pv))
+		return pv
+	}
+
+	t.Run("maps the PV and the volume recreated for it", func(t *testing.T) {
+		_, clone := testSnapshotRestoredPV("pvc-1", testRestore())
+		p := newTestRestorePlugin(t, nil, clone)
+		p.volumeMappings = mappings
+
+		pv := restorePV(t, p, clone.Name)
+		assert.Equal(t, "longhorn-dr", pv.Spec.StorageClassName)
+		assert.Equal(t, "longhorn", pv.Annotations[sourceStorageClassAnnotation])
+
+		vol, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(context.Background(), clone.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 2, vol.Spec.NumberOfReplicas)
+		assert.Equal(t, []string{"ssd"}, vol.Spec.DiskSelector)
+	})
+
+	t.Run("leaves a volume the restore did not recreate alone", func(t *testing.T) {
+		retained := &longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{Namespace: longhornNamespace, Name: "pvc-1"},
+			Spec:       longhorn.VolumeSpec{Size: gi, NumberOfReplicas: 3},
+		}
+		p := newTestRestorePlugin(t, nil, retained)
+		p.volumeMappings = mappings
+
+		pv := restorePV(t, p, "pvc-1")
+		assert.Equal(t, "longhorn-dr", pv.Spec.StorageClassName)
+
+		vol, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(context.Background(), "pvc-1", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 3, vol.Spec.NumberOfReplicas)
+	})
+
+	t.Run("leaves a PV the mapping does not match alone", func(t *testing.T) {
+		p := newTestRestorePlugin(t, nil)
+		p.volumeMappings = mappings
+
+		output, err := p.Execute(&velero.RestoreItemActionExecuteInput{
+			Item:           pvItem(t, "pvc-1", "dev"),
+			ItemFromBackup: pvItem(t, "pvc-1", "dev"),
+			Restore:        testRestore(),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, pvItem(t, "pvc-1", "dev"), output.UpdatedItem)
+	})
+}
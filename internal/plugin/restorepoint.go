@@ -0,0 +1,122 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// restorePointConfigKey chooses the Longhorn backup restored for a PVC
+	// among the backups of its volume: "recorded" for the one the Velero
+	// backup recorded, "latest" for the newest completed one, or an RFC 3339
+	// timestamp for the newest completed one created at or before it.
+	restorePointConfigKey = "restorePoint"
+	// restorePointAnnotation on the Velero restore overrides the restorePoint config.
+	restorePointAnnotation = "velero.io/longhorn-restore-point"
+
+	restorePointRecorded = "recorded"
+	restorePointLatest   = "latest"
+)
+
+// restorePoint selects a Longhorn backup of a volume. The zero value selects
+// the backup recorded by the Velero backup.
+type restorePoint struct {
+	latest bool
+	before time.Time
+}
+
+// recorded reports whether the point selects the recorded backup.
+func (r restorePoint) recorded() bool {
+	return !r.latest && r.before.IsZero()
+}
+
+// restorePoint returns the restore point of restore.
+func (p *RestorePluginV2) restorePoint(restore *v1.Restore) (restorePoint, error) {
+	v, ok := restore.Annotations[restorePointAnnotation]
+	if !ok {
+		v = p.config[restorePointConfigKey]
+	}
+	switch v {
+	case "", restorePointRecorded:
+		return restorePoint{}, nil
+	case restorePointLatest:
+		return restorePoint{latest: true}, nil
+	}
+	before, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return restorePoint{}, errors.Errorf("invalid restore point %q on restore %s: must be %s, %s or an RFC 3339 timestamp",
+			v, restore.Name, restorePointRecorded, restorePointLatest)
+	}
+	return restorePoint{before: before}, nil
+}
+
+// backupURLTarget returns the backup target part of a Longhorn backup URL.
+func backupURLTarget(backupURL string) string {
+	target, _, _ := strings.Cut(backupURL, "?")
+	return target
+}
+
+// selectBackup returns the completed Longhorn backup that point selects among
+// the backups of the volume of backupURL on the same backup target, or nil
+// if point selects the recorded backup or there is no newer one than it.
+func (c *longhornCache) selectBackup(backupURL string, point restorePoint) (*longhorn.Backup, error) {
+	if point.recorded() {
+		return nil, nil
+	}
+	volumeName := backupURLVolumeName(backupURL)
+	if volumeName == "" {
+		return nil, errors.Errorf("cannot tell the volume of Longhorn backup %s", backupURL)
+	}
+	backups, err := c.backups.List(labels.SelectorFromSet(labels.Set{backupVolumeLabel: volumeName}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list backups of volume %s", volumeName)
+	}
+
+	var selected *longhorn.Backup
+	var selectedAt time.Time
+	for _, backup := range backups {
+		if backup.Status.State != longhorn.BackupStateCompleted ||
+			backupURLTarget(backup.Status.URL) != backupURLTarget(backupURL) {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339, backup.Status.BackupCreatedAt)
+		if err != nil {
+			continue
+		}
+		if !point.latest && createdAt.After(point.before) {
+			continue
+		}
+		if selected == nil || createdAt.After(selectedAt) {
+			selected, selectedAt = backup, createdAt
+		}
+	}
+	if selected == nil && !point.latest {
+		return nil, errors.Errorf("volume %s has no completed Longhorn backup created at or before %s",
+			volumeName, point.before.Format(time.RFC3339))
+	}
+	return selected, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// testBackupURL returns the URL of a Longhorn backup of volumeName on target.
+func testBackupURL(target, name, volumeName string) string {
+	return target + "?backup=" + name + "&volume=" + volumeName
+}
+
+// testBackup returns a Longhorn Backup CR of volumeName on target.
+func testBackup(target, name, volumeName string, state longhorn.BackupState, createdAt string) *longhorn.Backup {
+	return &longhorn.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: longhornNamespace,
+			Name:      name,
+			Labels:    map[string]string{backupVolumeLabel: volumeName},
+		},
+		Status: longhorn.BackupStatus{
+			State:           state,
+			URL:             testBackupURL(target, name, volumeName),
+			BackupCreatedAt: createdAt,
+			VolumeName:      volumeName,
+		},
+	}
+}
+
+func TestSelectBackup(t *testing.T) {
+	const target = "s3://backups@us-east-1/"
+	objects := []runtime.Object{
+		testBackup(target, "backup-1", "pvc-1", longhorn.BackupStateCompleted, "2026-01-01T00:00:00Z"),
+		testBackup(target, "backup-2", "pvc-1", longhorn.BackupStateCompleted, "2026-01-02T00:00:00Z"),
+		testBackup(target, "backup-3", "pvc-1", longhorn.BackupStateCompleted, "2026-01-03T00:00:00Z"),
+		testBackup(target, "backup-4", "pvc-1", longhorn.BackupStateInProgress, "2026-01-04T00:00:00Z"),
+		testBackup("nfs://backups/", "backup-5", "pvc-1", longhorn.BackupStateCompleted, "2026-01-05T00:00:00Z"),
+		testBackup(target, "backup-6", "pvc-1", longhorn.BackupStateCompleted, ""),
+		testBackup(target, "backup-7", "pvc-2", longhorn.BackupStateCompleted, "2026-01-07T00:00:00Z"),
+	}
+	client, _ := newFakeLonghornClient(objects...)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	lhCache, err := newLonghornCache(client, stopCh)
+	require.NoError(t, err)
+
+	recorded := testBackupURL(target, "backup-1", "pvc-1")
+	at := func(v string) time.Time {
+		ts, err := time.Parse(time.RFC3339, v)
+		require.NoError(t, err)
+		return ts
+	}
+	tests := []struct {
+		name      string
+		backupURL string
+		point     restorePoint
+		want      string
+		wantErr   string
+	}{
+		{name: "recorded", backupURL: recorded, point: restorePoint{}, want: ""},
+		{name: "latest completed on the same target", backupURL: recorded, point: restorePoint{latest: true}, want: "backup-3"},
+		{name: "at a backup", backupURL: recorded, point: restorePoint{before: at("2026-01-02T00:00:00Z")}, want: "backup-2"},
+		{name: "between backups", backupURL: recorded, point: restorePoint{before: at("2026-01-02T12:00:00Z")}, want: "backup-2"},
+		{
+			name:      "before every backup",
+			backupURL: recorded,
+			point:     restorePoint{before: at("2025-12-31T00:00:00Z")},
+			wantErr:   "volume pvc-1 has no completed Longhorn backup created at or before 2025-12-31T00:00:00Z",
+		},
+		{name: "latest without newer backups", backupURL: testBackupURL(target, "backup-8", "pvc-3"), point: restorePoint{latest: true}, want: ""},
+		{
+			name:      "URL without volume",
+			backupURL: target + "?backup=backup-1",
+			point:     restorePoint{latest: true},
+			wantErr:   "cannot tell the volume of Longhorn backup " + target + "?backup=backup-1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			backup, err := lhCache.selectBackup(tc.backupURL, tc.point)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if tc.want == "" {
+				assert.Nil(t, backup)
+				return
+			}
+			require.NotNil(t, backup)
+			assert.Equal(t, tc.want, backup.Name)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// longhornRuntimeAnnotation marks a Longhorn CR that was stored without its
+// content because it only describes the state of the source cluster.
+const longhornRuntimeAnnotation = "velero.io/longhorn-runtime-object"
+
+// longhornRuntimeKinds are the Longhorn CRs Longhorn creates and manages
+// itself from the config kinds and the nodes it runs on. Restoring them on
+// another cluster, or even the same one later, corrupts Longhorn's state.
+var longhornRuntimeKinds = map[string]bool{
+	"Engine":                 true,
+	"Replica":                true,
+	"InstanceManager":        true,
+	"EngineImage":            true,
+	"Node":                   true,
+	"VolumeAttachment":       true,
+	"ShareManager":           true,
+	"Snapshot":               true,
+	"Backup":                 true,
+	"BackupVolume":           true,
+	"BackupBackingImage":     true,
+	"BackingImageManager":    true,
+	"BackingImageDataSource": true,
+	"Orphan":                 true,
+	"SupportBundle":          true,
+	"SystemBackup":           true,
+	"SystemRestore":          true,
+}
+
+// longhornNodeBindingFields are the spec fields of Longhorn config kinds that
+// tie an object to the nodes or disks of the source cluster.
+var longhornNodeBindingFields = map[string][][]string{
+	"Volume": {
+		{"spec", "nodeID"},
+		{"spec", "migrationNodeID"},
+		{"spec", "lastAttachedBy"},
+	},
+	"BackingImage": {
+		{"spec", "disks"},
+		{"spec", "diskFileSpecMap"},
+	},
+}
+
+// sanitizeLonghornItem returns the part of a Longhorn CR worth restoring.
+// Runtime kinds are reduced to their identity and marked with
+// longhornRuntimeAnnotation, since a backup item action cannot drop an item.
+// Config kinds such as Volumes, RecurringJobs, Settings, BackupTargets and
+// BackingImages lose their status, which holds OwnerID among other observed
+// state, and their node bindings.
+func sanitizeLonghornItem(item runtime.Unstructured) runtime.Unstructured {
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	kind := obj.GetKind()
+
+	if longhornRuntimeKinds[kind] {
+		stub := &unstructured.Unstructured{}
+		stub.SetAPIVersion(obj.GetAPIVersion())
+		stub.SetKind(kind)
+		stub.SetNamespace(obj.GetNamespace())
+		stub.SetName(obj.GetName())
+		stub.SetAnnotations(map[string]string{longhornRuntimeAnnotation: "true"})
+		return stub
+	}
+
+	unstructured.RemoveNestedField(obj.Object, "status")
+	for _, field := range longhornNodeBindingFields[kind] {
+		unstructured.RemoveNestedField(obj.Object, field...)
+	}
+	return obj
+}
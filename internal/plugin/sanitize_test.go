@@ -0,0 +1,120 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSanitizeLonghornItem(t *testing.T) {
+	tests := []struct {
+		name string
+		item map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "runtime kind is reduced to a stub",
+			item: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "Engine",
+				"metadata": map[string]interface{}{
+					"namespace": longhornNamespace,
+					"name":      "pvc-1-e-0",
+					"labels":    map[string]interface{}{"longhornvolume": "pvc-1"},
+				},
+				"spec":   map[string]interface{}{"volumeName": "pvc-1", "nodeID": "node-1"},
+				"status": map[string]interface{}{"ownerID": "node-1"},
+			},
+			want: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "Engine",
+				"metadata": map[string]interface{}{
+					"namespace":   longhornNamespace,
+					"name":        "pvc-1-e-0",
+					"annotations": map[string]interface{}{longhornRuntimeAnnotation: "true"},
+				},
+			},
+		},
+		{
+			name: "volume loses its status and node bindings",
+			item: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "Volume",
+				"metadata":   map[string]interface{}{"namespace": longhornNamespace, "name": "pvc-1"},
+				"spec": map[string]interface{}{
+					"size":            "1073741824",
+					"nodeID":          "node-1",
+					"migrationNodeID": "node-2",
+					"lastAttachedBy":  "node-1",
+				},
+				"status": map[string]interface{}{"ownerID": "node-1", "state": "attached"},
+			},
+			want: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "Volume",
+				"metadata":   map[string]interface{}{"namespace": longhornNamespace, "name": "pvc-1"},
+				"spec":       map[string]interface{}{"size": "1073741824"},
+			},
+		},
+		{
+			name: "backing image loses its disks",
+			item: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "BackingImage",
+				"metadata":   map[string]interface{}{"namespace": longhornNamespace, "name": "image"},
+				"spec": map[string]interface{}{
+					"sourceType":      "download",
+					"disks":           map[string]interface{}{"disk-1": ""},
+					"diskFileSpecMap": map[string]interface{}{"disk-1": map[string]interface{}{}},
+				},
+				"status": map[string]interface{}{"ownerID": "node-1"},
+			},
+			want: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "BackingImage",
+				"metadata":   map[string]interface{}{"namespace": longhornNamespace, "name": "image"},
+				"spec":       map[string]interface{}{"sourceType": "download"},
+			},
+		},
+		{
+			name: "other config kind only loses its status",
+			item: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "RecurringJob",
+				"metadata":   map[string]interface{}{"namespace": longhornNamespace, "name": "daily"},
+				"spec":       map[string]interface{}{"cron": "0 0 * * *", "task": "backup"},
+				"status":     map[string]interface{}{"ownerID": "node-1"},
+			},
+			want: map[string]interface{}{
+				"apiVersion": "longhorn.io/v1beta2",
+				"kind":       "RecurringJob",
+				"metadata":   map[string]interface{}{"namespace": longhornNamespace, "name": "daily"},
+				"spec":       map[string]interface{}{"cron": "0 0 * * *", "task": "backup"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := sanitizeLonghornItem(&unstructured.Unstructured{Object: tc.item})
+			assert.Equal(t, tc.want, got.UnstructuredContent())
+		})
+	}
+}
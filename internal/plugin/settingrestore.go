@@ -0,0 +1,189 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// includedSettingsConfigKey limits the restored Longhorn settings to a
+	// comma-separated list of names. All settings are restored when unset.
+	includedSettingsConfigKey = "includedSettings"
+	// excludedSettingsConfigKey adds a comma-separated list of names to the
+	// settings that are never restored.
+	excludedSettingsConfigKey = "excludedSettings"
+	// forceSettingsConfigKey restores settings over values changed on the
+	// target cluster, instead of only over Longhorn's defaults.
+	forceSettingsConfigKey = "forceSettings"
+
+	// longhornManagerService and longhornManagerPort expose the Longhorn
+	// manager API, the only place the setting definitions are published.
+	longhornManagerService = "longhorn-backend"
+	longhornManagerPort    = "9500"
+)
+
+// clusterSpecificSettings describe the nodes, images or Longhorn version of
+// the cluster they are set on, so they are not restored unless named in
+// includedSettings.
+var clusterSpecificSettings = map[string]bool{
+	"default-engine-image":                    true,
+	"default-instance-manager-image":          true,
+	"default-backing-image-manager-image":     true,
+	"support-bundle-manager-image":            true,
+	"current-longhorn-version":                true,
+	"latest-longhorn-version":                 true,
+	"stable-longhorn-versions":                true,
+	"registry-secret":                         true,
+	"taint-toleration":                        true,
+	"system-managed-components-node-selector": true,
+	"priority-class":                          true,
+	"storage-network":                         true,
+}
+
+// settingDefinition is the part of a Longhorn setting definition the plugin
+// needs.
+type settingDefinition struct {
+	ReadOnly bool   `json:"readOnly"`
+	Default  string `json:"default"`
+}
+
+// getSettingDefinitions returns the definitions of the settings known to the
+// Longhorn version of the cluster, by name. Longhorn publishes them through
+// its manager API only, which is reached through the API server proxy.
+func (c *longhornClient) getSettingDefinitions() (map[string]settingDefinition, error) {
+	var raw []byte
+	err := c.call("get setting definitions", func(ctx context.Context) error {
+		var err error
+		raw, err = c.k8s.CoreV1().Services(longhornNamespace).
+			ProxyGet("http", longhornManagerService, longhornManagerPort, "v1/settings", nil).DoRaw(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var settings struct {
+		Data []struct {
+			Name       string            `json:"name"`
+			Definition settingDefinition `json:"definition"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, errors.Wrap(err, "failed to decode Longhorn settings")
+	}
+	definitions := make(map[string]settingDefinition, len(settings.Data))
+	for _, setting := range settings.Data {
+		definitions[setting.Name] = setting.Definition
+	}
+	return definitions, nil
+}
+
+// settingSelected reports whether the plugin config lets the named setting
+// be restored.
+func (p *ResourceRestorePlugin) settingSelected(name string) bool {
+	for _, excluded := range listConfig(p.config, excludedSettingsConfigKey) {
+		if excluded == name {
+			return false
+		}
+	}
+	included := listConfig(p.config, includedSettingsConfigKey)
+	for _, v := range included {
+		if v == name {
+			return true
+		}
+	}
+	return len(included) == 0 && !clusterSpecificSettings[name]
+}
+
+// restoreSetting merges a backed up Setting into the target cluster, where
+// Longhorn has already created every setting it knows. The value is written
+// to the existing Setting, and only if the target still has Longhorn's
+// default or forceSettings is set. Settings that are read-only, cluster
+// specific, excluded by the config or unknown to the Longhorn version of the
+// target are left alone. The item itself is never restored, since Velero
+// would not update the existing Setting anyway.
+func (p *ResourceRestorePlugin) restoreSetting(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	backedUp := new(longhorn.Setting)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), backedUp); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	log := p.log.WithField("setting", backedUp.Name)
+	output := velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore()
+
+	if !p.settingSelected(backedUp.Name) {
+		log.Info("Skipping Longhorn setting, it is not selected for restore")
+		return output, nil
+	}
+	if p.settingDefinitions == nil {
+		definitions, err := p.client.getSettingDefinitions()
+		if err != nil {
+			return nil, err
+		}
+		p.settingDefinitions = definitions
+	}
+	definition, ok := p.settingDefinitions[backedUp.Name]
+	if !ok {
+		log.Info("Skipping Longhorn setting, the Longhorn version of the cluster does not know it")
+		return output, nil
+	}
+	if definition.ReadOnly {
+		log.Info("Skipping read-only Longhorn setting")
+		return output, nil
+	}
+	force, err := boolConfig(p.config, forceSettingsConfigKey, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.client.call("update setting "+backedUp.Name, func(ctx context.Context) error {
+		setting, err := p.client.lh.LonghornV1beta2().Settings(longhornNamespace).Get(ctx, backedUp.Name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				log.Info("Skipping Longhorn setting, the cluster has not created it")
+				return nil
+			}
+			return err
+		}
+		if setting.Value == backedUp.Value {
+			return nil
+		}
+		if !force && setting.Value != definition.Default {
+			log.Infof("Skipping Longhorn setting, the cluster changed it from the default to %q", setting.Value)
+			return nil
+		}
+		log.Infof("Restoring Longhorn setting value %q over %q", backedUp.Value, setting.Value)
+		setting.Value = backedUp.Value
+		_, err = p.client.lh.LonghornV1beta2().Settings(longhornNamespace).Update(ctx, setting, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingSelected(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		setting string
+		want    bool
+	}{
+		{name: "default", setting: "backup-compression-method", want: true},
+		{name: "cluster specific by default", setting: "storage-network", want: false},
+		{
+			name:    "excluded",
+			config:  map[string]string{excludedSettingsConfigKey: "concurrent-replica-rebuild-per-node-limit, backup-compression-method"},
+			setting: "backup-compression-method",
+			want:    false,
+		},
+		{
+			name:    "not excluded",
+			config:  map[string]string{excludedSettingsConfigKey: "concurrent-replica-rebuild-per-node-limit"},
+			setting: "backup-compression-method",
+			want:    true,
+		},
+		{
+			name:    "included",
+			config:  map[string]string{includedSettingsConfigKey: "backup-compression-method"},
+			setting: "backup-compression-method",
+			want:    true,
+		},
+		{
+			name:    "not included",
+			config:  map[string]string{includedSettingsConfigKey: "backup-compression-method"},
+			setting: "concurrent-replica-rebuild-per-node-limit",
+			want:    false,
+		},
+		{
+			name:    "cluster specific included",
+			config:  map[string]string{includedSettingsConfigKey: " storage-network ,backup-compression-method"},
+			setting: "storage-network",
+			want:    true,
+		},
+		{
+			name: "exclusion wins over inclusion",
+			config: map[string]string{
+				includedSettingsConfigKey: "backup-compression-method",
+				excludedSettingsConfigKey: "backup-compression-method",
+			},
+			setting: "backup-compression-method",
+			want:    false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &ResourceRestorePlugin{config: tc.config}
+			assert.Equal(t, tc.want, p.settingSelected(tc.setting))
+		})
+	}
+}
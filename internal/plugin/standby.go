@@ -0,0 +1,166 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// standbyConfigKey restores the Longhorn backups of PVCs as standby
+	// volumes, which keep restoring newer backups of their backup volume.
+	standbyConfigKey = "standbyVolumes"
+	// standbyAnnotation on the Velero restore overrides the standbyVolumes config.
+	standbyAnnotation = "velero.io/longhorn-standby"
+	// activateStandbyAnnotation on a Velero restore turns the standby volumes
+	// behind the PVCs it would restore into regular volumes, for failover.
+	activateStandbyAnnotation = "velero.io/longhorn-activate-standby"
+)
+
+// standbyEnabled reports whether restore creates standby volumes.
+func (p *RestorePluginV2) standbyEnabled(restore *v1.Restore) (bool, error) {
+	if v, ok := restore.Annotations[standbyAnnotation]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, errors.Errorf("invalid %s annotation %q on restore %s", standbyAnnotation, v, restore.Name)
+		}
+		return enabled, nil
+	}
+	return boolConfig(p.config, standbyConfigKey, false)
+}
+
+// activateStandbyRequested reports whether restore activates standby volumes.
+func activateStandbyRequested(restore *v1.Restore) (bool, error) {
+	v, ok := restore.Annotations[activateStandbyAnnotation]
+	if !ok {
+		return false, nil
+	}
+	activate, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.Errorf("invalid %s annotation %q on restore %s", activateStandbyAnnotation, v, restore.Name)
+	}
+	return activate, nil
+}
+
+// activateStandbyVolume activates the standby volume bound to the PVC that a
+// standby restore created in the cluster under the name of pvc. It reports
+// false if there is no such PVC or its volume is not a standby volume.
+func (p *RestorePluginV2) activateStandbyVolume(pvc *corev1api.PersistentVolumeClaim) (restoreOperation, bool, error) {
+	var existing *corev1api.PersistentVolumeClaim
+	err := p.client.call("get PVC "+pvc.Namespace+"/"+pvc.Name, func(ctx context.Context) error {
+		var err error
+		existing, err = p.client.k8s.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return restoreOperation{}, false, nil
+		}
+		return restoreOperation{}, false, err
+	}
+	if existing.Spec.VolumeName == "" {
+		return restoreOperation{}, false, nil
+	}
+	vol, err := p.cache.volumes.Get(existing.Spec.VolumeName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return restoreOperation{}, false, nil
+		}
+		return restoreOperation{}, false, errors.Wrapf(err, "failed to get volume %s", existing.Spec.VolumeName)
+	}
+	if !vol.Spec.Standby {
+		return restoreOperation{}, false, nil
+	}
+	if err := p.cache.checkStandbyCaughtUp(vol); err != nil {
+		return restoreOperation{}, false, err
+	}
+
+	p.log.WithField("volume", vol.Name).Infof("Activating standby volume of PVC %s/%s", pvc.Namespace, pvc.Name)
+	err = p.client.call("activate volume "+vol.Name, func(ctx context.Context) error {
+		vol, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Get(ctx, existing.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		vol.Spec.Standby = false
+		vol.Spec.Frontend = longhorn.VolumeFrontendBlockDev
+		_, err = p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Update(ctx, vol, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return restoreOperation{}, false, err
+	}
+	return restoreOperation{pvcNamespace: pvc.Namespace, pvcName: pvc.Name, volumeName: vol.Name}, true, nil
+}
+
+// checkStandbyCaughtUp returns an error unless the standby volume vol has
+// restored the latest backup of its backup volume and is not restoring any
+// other, the checks Longhorn's own activate action makes. Activating a volume
+// earlier would drop the backups it has not restored yet.
+func (c *longhornCache) checkStandbyCaughtUp(vol *longhorn.Volume) error {
+	backupVolumeName := backupURLVolumeName(vol.Spec.FromBackup)
+	backupVolumes, err := c.backupVolumes.List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "failed to list backup volumes")
+	}
+	var backupVolume *longhorn.BackupVolume
+	for _, bv := range backupVolumes {
+		// BackupVolume CRs are not named after their volume on every
+		// Longhorn version, so accept either name.
+		if bv.Name != backupVolumeName && bv.Spec.VolumeName != backupVolumeName {
+			continue
+		}
+		if vol.Spec.BackupTargetName != "" && bv.Spec.BackupTargetName != vol.Spec.BackupTargetName {
+			continue
+		}
+		backupVolume = bv
+	}
+	if backupVolume == nil {
+		return errors.Errorf("cannot activate standby volume %s: backup volume %s not found", vol.Name, backupVolumeName)
+	}
+
+	engines, err := c.engines.List(labels.SelectorFromSet(labels.Set{engineVolumeLabel: vol.Name}))
+	if err != nil {
+		return errors.Wrapf(err, "failed to list engines of volume %s", vol.Name)
+	}
+	if len(engines) == 0 {
+		return errors.Errorf("cannot activate standby volume %s: it has no engine", vol.Name)
+	}
+	for _, engine := range engines {
+		for _, status := range engine.Status.RestoreStatus {
+			if status != nil && status.IsRestoring {
+				return errors.Errorf("cannot activate standby volume %s: it is still restoring a backup", vol.Name)
+			}
+		}
+		if lastBackup := backupVolume.Status.LastBackupName; lastBackup != "" && engine.Status.LastRestoredBackup != lastBackup {
+			return errors.Errorf("cannot activate standby volume %s: it has not restored the latest backup %s of backup volume %s yet",
+				vol.Name, lastBackup, backupVolume.Name)
+		}
+	}
+	return nil
+}
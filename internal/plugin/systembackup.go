@@ -0,0 +1,250 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	biav2 "github.com/vmware-tanzu/velero/pkg/plugin/velero/backupitemaction/v2"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// systemBackupConfigKey enables creating a Longhorn SystemBackup with
+	// every Velero backup that includes Longhorn PVCs, PVs or CRs.
+	systemBackupConfigKey = "systemBackup"
+	// systemBackupAnnotation on the Velero backup overrides the systemBackup config.
+	systemBackupAnnotation = "velero.io/longhorn-system-backup"
+	// systemBackupVolumeBackupPolicyConfigKey sets the VolumeBackupPolicy of
+	// the SystemBackup: always, disabled or if-not-present.
+	systemBackupVolumeBackupPolicyConfigKey = "systemBackupVolumeBackupPolicy"
+
+	// systemBackupNameAnnotation and systemBackupVersionAnnotation record the
+	// SystemBackup taken with a Velero backup on the Backup itself.
+	systemBackupNameAnnotation    = "velero.io/longhorn-system-backup-name"
+	systemBackupVersionAnnotation = "velero.io/longhorn-system-backup-version"
+
+	// systemBackupOperationPrefix tells SystemBackup operation IDs apart from
+	// the IDs of volume backups.
+	systemBackupOperationPrefix = "system-backup/"
+)
+
+// systemBackupEnabled reports whether a Longhorn SystemBackup is created with backup.
+func (p *BackupPluginV2) systemBackupEnabled(backup *v1.Backup) (bool, error) {
+	if v, ok := backup.Annotations[systemBackupAnnotation]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, errors.Errorf("invalid %s annotation %q on backup %s", systemBackupAnnotation, v, backup.Name)
+		}
+		return enabled, nil
+	}
+	return boolConfig(p.config, systemBackupConfigKey, false)
+}
+
+// systemBackupVolumeBackupPolicy returns the configured VolumeBackupPolicy,
+// or an empty one to leave the choice to Longhorn.
+func (p *BackupPluginV2) systemBackupVolumeBackupPolicy() (longhorn.SystemBackupCreateVolumeBackupPolicy, error) {
+	policy := longhorn.SystemBackupCreateVolumeBackupPolicy(p.config[systemBackupVolumeBackupPolicyConfigKey])
+	switch policy {
+	case "",
+		longhorn.SystemBackupCreateVolumeBackupPolicyAlways,
+		longhorn.SystemBackupCreateVolumeBackupPolicyDisabled,
+		longhorn.SystemBackupCreateVolumeBackupPolicyIfNotPresent:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid %s %q: must be %s, %s or %s", systemBackupVolumeBackupPolicyConfigKey, policy,
+			longhorn.SystemBackupCreateVolumeBackupPolicyAlways,
+			longhorn.SystemBackupCreateVolumeBackupPolicyDisabled,
+			longhorn.SystemBackupCreateVolumeBackupPolicyIfNotPresent)
+	}
+}
+
+// systemBackupName returns the name of the SystemBackup taken with backup.
+// It derives from the backup UID so that a later backup reusing the name
+// gets its own SystemBackup.
+func systemBackupName(backup *v1.Backup) string {
+	return "velero-" + string(backup.UID)
+}
+
+// startSystemBackup creates the SystemBackup of backup if it is enabled and
+// returns the ID of the operation tracking it. Every item of the backup
+// calls it, and only the call that actually creates the SystemBackup gets
+// an operation ID, so Velero tracks it once.
+func (p *BackupPluginV2) startSystemBackup(backup *v1.Backup) (string, error) {
+	if backup.Status.Phase == v1.BackupPhaseFinalizing ||
+		backup.Status.Phase == v1.BackupPhaseFinalizingPartiallyFailed {
+		return "", nil
+	}
+	if err := p.init(); err != nil {
+		return "", err
+	}
+	enabled, err := p.systemBackupEnabled(backup)
+	if err != nil || !enabled {
+		return "", err
+	}
+	name := systemBackupName(backup)
+	if _, started := p.systemBackups.LoadOrStore(name, true); started {
+		return "", nil
+	}
+	policy, err := p.systemBackupVolumeBackupPolicy()
+	if err != nil {
+		return "", err
+	}
+
+	systemBackup := &longhorn.SystemBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				v1.BackupNameLabel: label.GetValidName(backup.Name),
+				v1.BackupUIDLabel:  string(backup.UID),
+			},
+		},
+		Spec: longhorn.SystemBackupSpec{
+			VolumeBackupPolicy: policy,
+		},
+	}
+	created := false
+	err = p.client.call("create system backup "+name, func(ctx context.Context) error {
+		_, err := p.client.lh.LonghornV1beta2().SystemBackups(longhornNamespace).Create(ctx, systemBackup, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// An earlier attempt may have timed out after the server created
+			// it, in which case it is still ours to track.
+			existing, err := p.client.lh.LonghornV1beta2().SystemBackups(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			created = existing.Labels[v1.BackupUIDLabel] == string(backup.UID)
+			return nil
+		}
+		created = err == nil
+		return err
+	})
+	if err != nil {
+		p.systemBackups.Delete(name)
+		return "", err
+	}
+	if !created {
+		return "", nil
+	}
+	p.log.Infof("Started Longhorn system backup %s", name)
+	return systemBackupOperationPrefix + name, nil
+}
+
+// parseSystemBackupOperation returns the SystemBackup name of a SystemBackup
+// operation ID, and false for the ID of any other operation.
+func parseSystemBackupOperation(operationID string) (string, bool, error) {
+	if !strings.HasPrefix(operationID, systemBackupOperationPrefix) {
+		return "", false, nil
+	}
+	name := strings.TrimPrefix(operationID, systemBackupOperationPrefix)
+	if name == "" {
+		return "", true, biav2.InvalidOperationIDError(operationID)
+	}
+	return name, true, nil
+}
+
+// systemBackupProgress reports the state of a SystemBackup started by
+// startSystemBackup and, once it is ready, records it on the Velero backup.
+func (p *BackupPluginV2) systemBackupProgress(name string, backup *v1.Backup) (velero.OperationProgress, error) {
+	progress := velero.OperationProgress{}
+
+	var systemBackup *longhorn.SystemBackup
+	err := p.client.call("get system backup "+name, func(ctx context.Context) error {
+		var err error
+		systemBackup, err = p.client.lh.LonghornV1beta2().SystemBackups(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return progress, err
+	}
+
+	progress.Started = systemBackup.CreationTimestamp.Time
+	progress.Updated = time.Now()
+	progress.Description = fmt.Sprintf("Longhorn system backup %s: %s", name, systemBackup.Status.State)
+
+	switch systemBackup.Status.State {
+	case longhorn.SystemBackupStateReady:
+		progress.Completed = true
+		if err := p.client.annotateBackup(backup, map[string]string{
+			systemBackupNameAnnotation:    name,
+			systemBackupVersionAnnotation: systemBackup.Status.Version,
+		}); err != nil {
+			return progress, err
+		}
+	case longhorn.SystemBackupStateError:
+		progress.Completed = true
+		progress.Err = fmt.Sprintf("Longhorn system backup %s failed", name)
+		for _, condition := range systemBackup.Status.Conditions {
+			if condition.Type == longhorn.SystemBackupConditionTypeError && condition.Status == longhorn.ConditionStatusTrue {
+				progress.Err = fmt.Sprintf("Longhorn system backup %s failed: %s: %s", name, condition.Reason, condition.Message)
+			}
+		}
+	}
+	return progress, nil
+}
+
+// cancelSystemBackup deletes a SystemBackup that has not become ready yet.
+func (p *BackupPluginV2) cancelSystemBackup(name string) error {
+	return p.client.call("delete system backup "+name, func(ctx context.Context) error {
+		systemBackup, err := p.client.lh.LonghornV1beta2().SystemBackups(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		if systemBackup.Status.State == longhorn.SystemBackupStateReady {
+			return nil
+		}
+		err = p.client.lh.LonghornV1beta2().SystemBackups(longhornNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// annotateBackup merges annotations into the Velero Backup, which Velero
+// persists to the backup storage location when it finalizes the backup.
+func (c *longhornClient) annotateBackup(backup *v1.Backup, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return c.call("annotate backup "+backup.Name, func(ctx context.Context) error {
+		_, err := c.dyn.Resource(v1.SchemeGroupVersion.WithResource("backups")).Namespace(backup.Namespace).
+			Patch(ctx, backup.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
@@ -0,0 +1,136 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+const (
+	// volumeParamsAnnotation holds the JSON encoded volumeParams of the volume
+	// a snapshot was taken from.
+	volumeParamsAnnotation = "velero.io/longhorn-volume-params"
+
+	settingNameStorageNetworkForRWXVolumeEnabled = "storage-network-for-rwx-volume-enabled"
+	settingNameRWXVolumeFastFailover             = "rwx-volume-fast-failover"
+)
+
+// volumeParams are the Longhorn volume settings recorded at backup time that
+// a restored volume has to be created with.
+type volumeParams struct {
+	Size             int64                   `json:"size,string"`
+	NumberOfReplicas int                     `json:"numberOfReplicas"`
+	DataEngine       longhorn.DataEngineType `json:"dataEngine"`
+	AccessMode       longhorn.AccessMode     `json:"accessMode"`
+	Migratable       bool                    `json:"migratable"`
+
+	// FSType is the filesystem of the PV, recorded when the PV is recreated
+	// by the plugin rather than by Velero.
+	FSType string `json:"fsType,omitempty"`
+
+	// ShareManagerSettings holds the global settings that shape how the share
+	// manager serves an RWX volume, as they were when the backup was taken.
+	ShareManagerSettings map[string]string `json:"shareManagerSettings,omitempty"`
+}
+
+// newVolumeParams captures the parameters of vol.
+func newVolumeParams(vol *longhorn.Volume) *volumeParams {
+	return &volumeParams{
+		Size:             vol.Spec.Size,
+		NumberOfReplicas: vol.Spec.NumberOfReplicas,
+		DataEngine:       vol.Spec.DataEngine,
+		AccessMode:       vol.Spec.AccessMode,
+		Migratable:       vol.Spec.Migratable,
+	}
+}
+
+// isRWX reports whether the volume is served through a share manager.
+func (v *volumeParams) isRWX() bool {
+	return v.AccessMode == longhorn.AccessModeReadWriteMany
+}
+
+// volumeParamsFromAnnotations decodes the parameters recorded on an object,
+// returning nil if none were recorded.
+func volumeParamsFromAnnotations(annotations map[string]string) (*volumeParams, error) {
+	raw, ok := annotations[volumeParamsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	params := &volumeParams{}
+	if err := json.Unmarshal([]byte(raw), params); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s annotation", volumeParamsAnnotation)
+	}
+	return params, nil
+}
+
+// setAnnotation records the parameters in annotations.
+func (v *volumeParams) setAnnotation(annotations map[string]string) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	annotations[volumeParamsAnnotation] = string(raw)
+	return nil
+}
+
+// spec returns the spec of a new volume with these parameters.
+func (v *volumeParams) spec() longhorn.VolumeSpec {
+	return longhorn.VolumeSpec{
+		Size:             v.Size,
+		Frontend:         longhorn.VolumeFrontendBlockDev,
+		NumberOfReplicas: v.NumberOfReplicas,
+		DataEngine:       v.DataEngine,
+		AccessMode:       v.AccessMode,
+		Migratable:       v.Migratable,
+	}
+}
+
+// snapshotDataSource returns the data source that clones a volume from a snapshot.
+func snapshotDataSource(volumeName, snapshotName string) longhorn.VolumeDataSource {
+	return longhorn.VolumeDataSource(fmt.Sprintf("snap://%s/%s", volumeName, snapshotName))
+}
+
+// getShareManagerSettings reads the global settings that affect RWX volumes.
+// Settings missing from the cluster, e.g. on older Longhorn versions, are left out.
+func (c *longhornClient) getShareManagerSettings() (map[string]string, error) {
+	settings := map[string]string{}
+	for _, name := range []string{settingNameStorageNetworkForRWXVolumeEnabled, settingNameRWXVolumeFastFailover} {
+		var setting *longhorn.Setting
+		err := c.call("get setting "+name, func(ctx context.Context) error {
+			var err error
+			setting, err = c.lh.LonghornV1beta2().Settings(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		settings[name] = setting.Value
+	}
+	return settings, nil
+}
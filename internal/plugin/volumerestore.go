@@ -0,0 +1,214 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+// settingNameDefaultEngineImage is the setting holding the engine image new
+// volumes run with.
+const settingNameDefaultEngineImage = "default-engine-image"
+
+// getSettingValue returns the value of the named Longhorn setting, or an
+// empty string if the cluster has no such setting.
+func (c *longhornClient) getSettingValue(name string) (string, error) {
+	var setting *longhorn.Setting
+	err := c.call("get setting "+name, func(ctx context.Context) error {
+		var err error
+		setting, err = c.lh.LonghornV1beta2().Settings(longhornNamespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return setting.Value, nil
+}
+
+// restoreVolume rewrites a backed up Volume CR for the target cluster. The
+// fields tying it to the nodes and engine image of the source cluster are
+// cleared, the engine image is set to the target's default, and the volume
+// mapping of its PV is applied. A volume that the restore already recreated
+// from a snapshot or backup is skipped. The CR is edited as unstructured
+// content so that fields unknown to the plugin survive.
+func (p *ResourceRestorePlugin) restoreVolume(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+	log := p.log.WithField("volume", obj.GetName())
+
+	recreated, err := p.cache.isRecreatedVolume(obj.GetName(), input.Restore)
+	if err != nil {
+		return nil, err
+	}
+	if recreated {
+		log.Info("Skipping Longhorn volume, the restore recreated it from its backup")
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	unstructured.RemoveNestedField(obj.Object, "status")
+	for _, field := range longhornNodeBindingFields["Volume"] {
+		unstructured.RemoveNestedField(obj.Object, field...)
+	}
+	image, err := p.client.getSettingValue(settingNameDefaultEngineImage)
+	if err != nil {
+		return nil, err
+	}
+	if image != "" {
+		if err := unstructured.SetNestedField(obj.Object, image, "spec", "image"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else {
+		unstructured.RemoveNestedField(obj.Object, "spec", "image")
+	}
+
+	mapping, err := p.findVolumeMapping(obj, input.Restore)
+	if err != nil {
+		return nil, err
+	}
+	if mapping != nil {
+		log.Info("Applying volume mapping")
+		if err := mapping.applyToUnstructured(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.checkVolumeSelectors(obj); err != nil {
+		return nil, err
+	}
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
+
+// findVolumeMapping returns the volume mapping matching the PV restore
+// restored for the backed up Volume CR obj, the way RestorePluginV2 matched
+// the PV itself, or nil if none does. Volumes without a restored PV are not
+// mapped, since only their PV tells their storage class and namespace.
+func (p *ResourceRestorePlugin) findVolumeMapping(obj *unstructured.Unstructured, restore *v1.Restore) (*volumeMapping, error) {
+	if len(p.volumeMappings) == 0 {
+		return nil, nil
+	}
+	selector := labels.SelectorFromSet(labels.Set{v1.RestoreNameLabel: label.GetValidName(restore.Name)})
+	var list *corev1api.PersistentVolumeList
+	err := p.client.call("list persistent volumes of restore "+restore.Name, func(ctx context.Context) error {
+		var err error
+		list, err = p.client.k8s.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		pv := &list.Items[i]
+		if longhornVolumeName(pv) != obj.GetName() {
+			continue
+		}
+		storageClass := pv.Spec.StorageClassName
+		if sc, ok := pv.Annotations[sourceStorageClassAnnotation]; ok {
+			storageClass = sc
+		}
+		return findVolumeMapping(p.volumeMappings, storageClass, sourceNamespace(pv, restore), pv.Labels), nil
+	}
+	return nil, nil
+}
+
+// sourceNamespace returns the namespace the claim of a restored PV was
+// backed up from, undoing the namespace mapping of restore.
+func sourceNamespace(pv *corev1api.PersistentVolume, restore *v1.Restore) string {
+	if pv.Spec.ClaimRef == nil {
+		return ""
+	}
+	for source, target := range restore.Spec.NamespaceMapping {
+		if target == pv.Spec.ClaimRef.Namespace {
+			return source
+		}
+	}
+	return pv.Spec.ClaimRef.Namespace
+}
+
+// checkVolumeSelectors warns when fewer nodes of the target cluster match
+// the node and disk selectors of the volume than it has replicas, since
+// Longhorn then cannot schedule all of them.
+func (p *ResourceRestorePlugin) checkVolumeSelectors(obj *unstructured.Unstructured) error {
+	nodeSelector, _, _ := unstructured.NestedStringSlice(obj.Object, "spec", "nodeSelector")
+	diskSelector, _, _ := unstructured.NestedStringSlice(obj.Object, "spec", "diskSelector")
+	replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "numberOfReplicas")
+	if len(nodeSelector) == 0 && len(diskSelector) == 0 {
+		return nil
+	}
+
+	nodes, err := p.cache.nodes.List(labels.Everything())
+	if err != nil {
+		return errors.Wrap(err, "failed to list nodes")
+	}
+	eligible := 0
+	for _, node := range nodes {
+		if isSchedulableNode(node, nodeSelector, diskSelector) {
+			eligible++
+		}
+	}
+	if int64(eligible) < replicas {
+		p.log.WithField("volume", obj.GetName()).Warnf("Only %d nodes match node selector %v and disk selector %v, the volume needs %d replicas",
+			eligible, nodeSelector, diskSelector, replicas)
+	}
+	return nil
+}
+
+// isSchedulableNode reports whether Longhorn may schedule a replica on node
+// with the given node and disk selectors.
+func isSchedulableNode(node *longhorn.Node, nodeSelector, diskSelector []string) bool {
+	if !node.Spec.AllowScheduling || !hasTags(node.Spec.Tags, nodeSelector) {
+		return false
+	}
+	for _, disk := range node.Spec.Disks {
+		if disk.AllowScheduling && hasTags(disk.Tags, diskSelector) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTags reports whether tags contains every selector tag.
+func hasTags(tags, selector []string) bool {
+	for _, want := range selector {
+		found := false
+		for _, tag := range tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
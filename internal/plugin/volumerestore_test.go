@@ -0,0 +1,130 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+)
+
+// testVolumeMappings maps the volumes of class longhorn in namespace prod to
+// two replicas on SSDs.
+const testVolumeMappings = `
+- match:
+    storageClass: longhorn
+    namespace: prod
+  storageClass: longhorn-dr
+  numberOfReplicas: 2
+  diskSelector: [ssd]
+`
+
+// testVolumeItem returns the backed up Volume CR pvc-1 with three replicas
+// and a field the plugin does not know about.
+func testVolumeItem() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "longhorn.io/v1beta2",
+		"kind":       "Volume",
+		"metadata":   map[string]interface{}{"namespace": longhornNamespace, "name": "pvc-1"},
+		"spec": map[string]interface{}{
+			"numberOfReplicas": int64(3),
+			"futureField":      "kept",
+		},
+	}}
+}
+
+func TestRestoreVolumeMapping(t *testing.T) {
+	restore := testRestore()
+	restore.Spec.NamespaceMapping = map[string]string{"prod": "prod-dr"}
+	// The PV restore restored for the volume, whose storage class the
+	// mapping already changed.
+	restoredPV := func() *corev1api.PersistentVolume {
+		pv := testLonghornPV("pvc-1", "pvc-1")
+		pv.Labels = map[string]string{v1.RestoreNameLabel: restore.Name}
+		pv.Annotations = map[string]string{sourceStorageClassAnnotation: "longhorn"}
+		pv.Spec.StorageClassName = "longhorn-dr"
+		pv.Spec.ClaimRef = &corev1api.ObjectReference{Namespace: "prod-dr", Name: "data"}
+		return pv
+	}
+	mappings, err := parseVolumeMappings(map[string]string{volumeMappingsConfigKey: testVolumeMappings})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		pv     func() *corev1api.PersistentVolume
+		mapped bool
+	}{
+		{name: "maps the volume of a restored PV", pv: restoredPV, mapped: true},
+		{name: "leaves a volume without a restored PV alone"},
+		{
+			name: "leaves the volume of a PV of another restore alone",
+			pv: func() *corev1api.PersistentVolume {
+				pv := restoredPV()
+				pv.Labels[v1.RestoreNameLabel] = "restore-0"
+				return pv
+			},
+		},
+		{
+			name: "leaves a volume the mapping does not match alone",
+			pv: func() *corev1api.PersistentVolume {
+				pv := restoredPV()
+				pv.Spec.ClaimRef.Namespace = "dev"
+				return pv
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tc.pv != nil {
+				objects = append(objects, tc.pv())
+			}
+			client, _ := newFakeLonghornClient(objects...)
+			p := &ResourceRestorePlugin{
+				log:            client.log,
+				client:         client,
+				cache:          newFakeLonghornCache(t, client),
+				config:         map[string]string{},
+				volumeMappings: mappings,
+			}
+
+			output, err := p.Execute(&velero.RestoreItemActionExecuteInput{
+				Item:           testVolumeItem(),
+				ItemFromBackup: testVolumeItem(),
+				Restore:        restore,
+			})
+			require.NoError(t, err)
+			spec := output.UpdatedItem.UnstructuredContent()["spec"].(map[string]interface{})
+			assert.Equal(t, "kept", spec["futureField"])
+			if !tc.mapped {
+				assert.Equal(t, int64(3), spec["numberOfReplicas"])
+				assert.NotContains(t, spec, "diskSelector")
+				return
+			}
+			assert.Equal(t, int64(2), spec["numberOfReplicas"])
+			assert.Equal(t, []interface{}{"ssd"}, spec["diskSelector"])
+		})
+	}
+}
@@ -18,6 +18,7 @@ package plugin
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -25,17 +26,23 @@ import (
 	vsv1 "github.com/vmware-tanzu/velero/pkg/plugin/velero/volumesnapshotter/v1"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 
 	bsutil "github.com/longhorn/backupstore/util"
 	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
-	lhclientset "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned"
+)
+
+const (
+	// snapshotTimeoutConfigKey overrides how long CreateSnapshot waits for
+	// Longhorn to report the snapshot ready.
+	snapshotTimeoutConfigKey = "snapshotTimeout"
+
+	defaultSnapshotTimeout = 5 * time.Minute
 )
 
 // Volume keeps track of volumes created by this plugin
@@ -45,6 +52,7 @@ type Volume struct {
 	storageClass string
 	dataEngine   string
 	size         resource.Quantity
+	healthPolicy unhealthyVolumePolicy
 }
 
 // Snapshot keeps track of snapshots created by this plugin
@@ -60,8 +68,15 @@ type VolumeSnapshotter struct {
 	volumes   map[string]*Volume
 	snapshots map[string]*Snapshot
 
-	k8sClient *kubernetes.Clientset
-	lhClient  *lhclientset.Clientset
+	client *longhornClient
+	cache  *longhornCache
+
+	snapshotTimeout            time.Duration
+	unhealthyVolumePolicy      unhealthyVolumePolicy
+	unhealthyVolumeWaitTimeout time.Duration
+	migrationWaitTimeout       time.Duration
+	preserveVolumeNames        bool
+	capacityCheck              string
 }
 
 // NewVolumeSnapshotter instantiates a VolumeSnapshotter.
@@ -86,25 +101,45 @@ func (p *VolumeSnapshotter) Init(config map[string]string) error {
 		p.snapshots = make(map[string]*Snapshot)
 	}
 
-	conf, err := rest.InClusterConfig()
+	client, err := newLonghornClient(p.FieldLogger, config)
+	if err != nil {
+		p.Errorf("Failed to create Longhorn client. %s", err)
+		return err
+	}
+	p.client = client
+
+	lhCache, err := getLonghornCache(client)
 	if err != nil {
-		p.Errorf("Failed to get cluster config : %s", err.Error())
-		return errors.New("error fetching cluster config")
+		p.Errorf("Failed to start Longhorn informers. %s", err)
+		return err
 	}
+	p.cache = lhCache
 
-	k8sClientset, err := kubernetes.NewForConfig(conf)
+	p.snapshotTimeout, err = durationConfig(config, snapshotTimeoutConfigKey, defaultSnapshotTimeout)
 	if err != nil {
-		p.Errorf("Error creating k8s clientset : %s", err.Error())
-		return errors.Wrap(err, "failed to create k8s client")
+		return err
 	}
-	p.k8sClient = k8sClientset
 
-	lhClient, err := lhclientset.NewForConfig(conf)
+	p.unhealthyVolumePolicy, err = parseUnhealthyVolumePolicy(config[unhealthyVolumePolicyConfigKey], defaultUnhealthyVolumePolicy)
 	if err != nil {
-		p.Errorf("Failed to create Longhorn client. %s", err)
-		return errors.Wrap(err, "failed to create longhorn client")
+		return err
+	}
+	p.unhealthyVolumeWaitTimeout, err = durationConfig(config, unhealthyVolumeWaitTimeoutConfigKey, defaultUnhealthyVolumeWaitTimeout)
+	if err != nil {
+		return err
+	}
+	p.migrationWaitTimeout, err = durationConfig(config, migrationWaitTimeoutConfigKey, defaultMigrationWaitTimeout)
+	if err != nil {
+		return err
+	}
+	p.preserveVolumeNames, err = boolConfig(config, preserveVolumeNamesConfigKey, false)
+	if err != nil {
+		return err
+	}
+	p.capacityCheck, err = capacityCheckMode(config)
+	if err != nil {
+		return err
 	}
-	p.lhClient = lhClient
 
 	return nil
 }
@@ -113,12 +148,91 @@ func (p *VolumeSnapshotter) Init(config map[string]string) error {
 // availability zone, initialized from the provided snapshot,
 // and with the specified type and IOPS (if using provisioned IOPS).
 func (p *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
-	p.Infof("CreateVolumeFromSnapshot called", snapshotID, volumeType, volumeAZ, *iops)
-	var volumeID string
+	p.Infof("CreateVolumeFromSnapshot called", snapshotID, volumeType, volumeAZ, iops)
+
+	snapshot, err := p.cache.snapshots.Get(snapshotID)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get snapshot %s", snapshotID)
+	}
+
+	params, err := volumeParamsFromAnnotations(snapshot.Annotations)
+	if err != nil {
+		return "", err
+	}
+	if params == nil {
+		// Snapshots taken before the parameters were recorded: fall back to
+		// the source volume as it is now.
+		source, err := p.cache.volumes.Get(snapshot.Spec.Volume)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get source volume %s of snapshot %s", snapshot.Spec.Volume, snapshotID)
+		}
+		params = newVolumeParams(source)
+	}
+	if params.isRWX() {
+		p.warnOnShareManagerSettingsDrift(snapshotID, params)
+	}
+
+	// Velero gives the snapshotter no restore identity, so the name has to be
+	// random to keep restores of the same backup apart.
+	volumeID := "velero-" + bsutil.GenerateName("vol")
+	if p.preserveVolumeNames {
+		available, err := p.client.volumeNameAvailable(snapshot.Spec.Volume, "")
+		if err != nil {
+			return "", err
+		}
+		if available {
+			volumeID = snapshot.Spec.Volume
+		}
+	}
+	volume := &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   volumeID,
+			Labels: map[string]string{sourceVolumeLabel: snapshot.Spec.Volume},
+		},
+		Spec: params.spec(),
+	}
+	volume.Spec.DataSource = snapshotDataSource(snapshot.Spec.Volume, snapshotID)
+	if err := p.client.checkVolumeCapacity(p.cache, volume, p.capacityCheck); err != nil {
+		return "", err
+	}
+
+	p.Infof("Creating volume %v (access mode %v, migratable %v) from snapshot %v", volumeID, params.AccessMode, params.Migratable, snapshotID)
+	err = p.client.call("create volume "+volumeID, func(ctx context.Context) error {
+		_, err := p.client.lh.LonghornV1beta2().Volumes(longhornNamespace).Create(ctx, volume, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	p.volumes[volumeID] = &Volume{
+		volName:    volumeID,
+		volAZ:      volumeAZ,
+		dataEngine: string(params.DataEngine),
+		size:       *resource.NewQuantity(params.Size, resource.BinarySI),
+	}
 
 	return volumeID, nil
 }
 
+// warnOnShareManagerSettingsDrift logs the share manager settings that differ
+// between the cluster the RWX volume was backed up from and this one.
+func (p *VolumeSnapshotter) warnOnShareManagerSettingsDrift(snapshotID string, params *volumeParams) {
+	current, err := p.client.getShareManagerSettings()
+	if err != nil {
+		p.WithError(err).Warnf("Failed to compare share manager settings for snapshot %v", snapshotID)
+		return
+	}
+	for name, value := range params.ShareManagerSettings {
+		if current[name] != value {
+			p.Warnf("Setting %v was %q when snapshot %v was taken but is %q now, the restored RWX volume may be served differently", name, value, snapshotID, current[name])
+		}
+	}
+}
+
 // GetVolumeInfo returns the type and IOPS (if using provisioned IOPS) for
 // the specified volume in the given availability zone.
 func (p *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
@@ -126,7 +240,8 @@ func (p *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *i
 	return "longhorn-volume", nil, nil
 }
 
-// IsVolumeReady Check if the volume is ready.
+// IsVolumeReady Check if the volume is ready. Velero does not call it, so
+// the restore of volumes is tracked by the pod restore action instead.
 func (p *VolumeSnapshotter) IsVolumeReady(volumeID, volumeAZ string) (ready bool, err error) {
 	p.Infof("IsVolumeReady called", volumeID, volumeAZ)
 	return true, nil
@@ -138,6 +253,30 @@ func (p *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 	p.Infof("CreateSnapshot called", volumeID, volumeAZ, tags)
 	var snapshotID string
 
+	if err := p.waitForMigration(volumeID); err != nil {
+		return "", err
+	}
+
+	policy := p.unhealthyVolumePolicy
+	if v, exists := p.volumes[volumeID]; exists && v.healthPolicy != "" {
+		policy = v.healthPolicy
+	}
+	if err := p.applyUnhealthyVolumePolicy(volumeID, policy); err != nil {
+		return "", err
+	}
+
+	vol, err := p.cache.volumes.Get(volumeID)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get volume %s", volumeID)
+	}
+
+	params := newVolumeParams(vol)
+	if params.isRWX() {
+		if params.ShareManagerSettings, err = p.client.getShareManagerSettings(); err != nil {
+			return "", err
+		}
+	}
+
 	for {
 		snapshotID = "velero-" + bsutil.GenerateName("snap")
 		p.Infof("CreateSnapshot trying to create snapshot", snapshotID)
@@ -167,7 +306,8 @@ func (p *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 
 	snapshotCR := &longhorn.Snapshot{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: snapshotID,
+			Name:        snapshotID,
+			Annotations: map[string]string{},
 		},
 		Spec: longhorn.SnapshotSpec{
 			Volume:         volumeID,
@@ -175,9 +315,18 @@ func (p *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 		},
 	}
 
+	if err := params.setAnnotation(snapshotCR.Annotations); err != nil {
+		return "", err
+	}
+
 	p.Infof("Creating snapshot %v for volume %v", snapshotID, volumeID)
-	_, err := p.lhClient.LonghornV1beta2().Snapshots("longhorn-system").Create(context.TODO(), snapshotCR, metav1.CreateOptions{})
-	if err != nil {
+	if err := p.client.createSnapshot(snapshotCR); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.snapshotTimeout)
+	defer cancel()
+	if err := p.cache.waitForSnapshotReady(ctx, snapshotID); err != nil {
 		return "", err
 	}
 
@@ -205,6 +354,24 @@ func (p *VolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (st
 		return "", nil
 	}
 
+	policy, err := p.volumeUnhealthyVolumePolicy(pv)
+	if err != nil {
+		return "", err
+	}
+	if policy == unhealthyVolumePolicySkip {
+		vol, err := p.cache.volumes.Get(pv.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", errors.Wrapf(err, "failed to get volume %s", pv.Name)
+		}
+		if vol != nil {
+			if problem := volumeHealthProblem(vol); problem != "" {
+				// Velero skips the volume when no volume ID is returned.
+				p.WithField("volume", pv.Name).WithField("unhealthyVolumePolicy", policy).Warnf("Skipping snapshot of volume: %s", problem)
+				return "", nil
+			}
+		}
+	}
+
 	if _, exists := p.volumes[pv.Name]; !exists {
 		p.volumes[pv.Name] = &Volume{
 			volName:      pv.Name,
@@ -213,6 +380,7 @@ func (p *VolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (st
 			dataEngine:   "v1",
 		}
 	}
+	p.volumes[pv.Name].healthPolicy = policy
 
 	return pv.Name, nil
 }
@@ -232,6 +400,9 @@ func (p *VolumeSnapshotter) SetVolumeID(unstructuredPV runtime.Unstructured, vol
 	}
 
 	pv.Name = vol.volName
+	if pv.Spec.CSI != nil {
+		pv.Spec.CSI.VolumeHandle = vol.volName
+	}
 	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
 	if err != nil {
 		return nil, errors.WithStack(err)
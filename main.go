@@ -25,7 +25,10 @@ import (
 func main() {
 	framework.NewServer().
 		RegisterVolumeSnapshotter("longhorn.io/volume-snapshotter-plugin", newVolumeSnapshotterPlugin).
-		RegisterBackupItemActionV2("longhorn.io/backup-pluginv2", newBackupPluginV2).
+		RegisterBackupItemActionV2(plugin.BackupPluginV2Name, newBackupPluginV2).
+		RegisterRestoreItemActionV2(plugin.RestorePluginV2Name, newRestorePluginV2).
+		RegisterRestoreItemActionV2(plugin.ResourceRestorePluginName, newResourceRestorePlugin).
+		RegisterRestoreItemActionV2(plugin.PodRestorePluginName, newPodRestorePlugin).
 		Serve()
 }
 
@@ -33,6 +36,18 @@ func newBackupPluginV2(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewBackupPluginV2(logger), nil
 }
 
+func newRestorePluginV2(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewRestorePluginV2(logger), nil
+}
+
+func newResourceRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewResourceRestorePlugin(logger), nil
+}
+
+func newPodRestorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewPodRestorePlugin(logger), nil
+}
+
 func newVolumeSnapshotterPlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewVolumeSnapshotter(logger), nil
 }